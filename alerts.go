@@ -0,0 +1,208 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// alertmanagerWebhook is the payload sent by the webhook receivers of the
+// Alertmanager, version 4.
+type alertmanagerWebhook struct {
+	Version           string            `json:"version"`
+	GroupKey          string            `json:"groupKey"`
+	TruncatedAlerts   int               `json:"truncatedAlerts"`
+	Status            string            `json:"status"`
+	Receiver          string            `json:"receiver"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Alerts            []webhookAlert    `json:"alerts"`
+}
+
+type webhookAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+// alertRecord is an alert ready to be produced, keyed by its fingerprint so
+// the events of an alert keep their order.
+type alertRecord struct {
+	topic string
+	key   []byte
+	value []byte
+}
+
+func newAlertSerializer(format string) (Serializer, error) {
+	switch format {
+	case "json":
+		return NewJSONSerializer()
+	case "avro-json":
+		return NewAvroJSONSerializer("schemas/alert.avsc")
+	default:
+		return nil, errUnknownFormat
+	}
+}
+
+// alertsHandler publishes every alert of an Alertmanager notification as a
+// record in the topic rendered from its labels.
+func alertsHandler(serializer Serializer) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		httpRequestsTotal.Add(float64(1))
+
+		meta, ok := ingestMeta(c)
+		if !ok {
+			return
+		}
+
+		var payload alertmanagerWebhook
+		if err := json.NewDecoder(c.Request.Body).Decode(&payload); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			c.Abort()
+			logrus.WithError(err).Error("couldn't unmarshal alerts")
+			return
+		}
+		if payload.Version != "4" {
+			c.String(http.StatusBadRequest, fmt.Sprintf("unsupported webhook version %q", payload.Version))
+			c.Abort()
+			return
+		}
+
+		records, err := alertRecords(serializer, &payload, meta.tenant)
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			logrus.WithError(err).Error("couldn't serialize alerts")
+			return
+		}
+
+		status, err := produceAlerts(serializer, records, meta, requestIdentity(c))
+		if err != nil {
+			respondIngest(c, status, err)
+			return
+		}
+		for _, a := range payload.Alerts {
+			alertsReceived.WithLabelValues(a.Status).Inc()
+		}
+		c.Status(status)
+	}
+}
+
+// alertRecords serializes the alerts of a notification, along with the
+// fields of the notification they belong to.
+func alertRecords(serializer Serializer, payload *alertmanagerWebhook, tenant string) ([]alertRecord, error) {
+	records := make([]alertRecord, 0, len(payload.Alerts))
+	for _, a := range payload.Alerts {
+		labels, annotations := a.Labels, a.Annotations
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		value, err := serializer.Marshal(map[string]interface{}{
+			"status":       a.Status,
+			"labels":       labels,
+			"annotations":  annotations,
+			"startsAt":     a.StartsAt.Format(time.RFC3339Nano),
+			"endsAt":       a.EndsAt.Format(time.RFC3339Nano),
+			"generatorURL": a.GeneratorURL,
+			"fingerprint":  a.Fingerprint,
+			"groupKey":     payload.GroupKey,
+			"receiver":     payload.Receiver,
+		})
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, alertRecord{
+			topic: renderTopic(alertsTopicTemplate, labels, tenant),
+			key:   []byte(a.Fingerprint),
+			value: value,
+		})
+	}
+	return records, nil
+}
+
+// produceAlerts produces the alert records in the default sink, returning
+// the http status the request must be answered with.
+func produceAlerts(serializer Serializer, records []alertRecord, meta requestMeta, id *identity) (int, error) {
+	for _, r := range records {
+		if !requestAuth.authorizeTopic(id, r.topic) {
+			authFailures.WithLabelValues(reasonForbiddenTopic).Inc()
+			logrus.WithFields(logrus.Fields{"principal": id.principal, "topic": r.topic}).Warn("forbidden topic")
+			return http.StatusForbidden, fmt.Errorf("principal %q is not allowed to write to topic %q", id.principal, r.topic)
+		}
+	}
+
+	// As in ingest, every topic is checked once against its circuit breaker
+	// before producing anything, so a request is a single trial of a
+	// half-open breaker whatever its number of alerts.
+	now := time.Now()
+	producers := make(map[string]*reloadableProducer)
+	trials := make(map[string]*breakerTrial)
+	defer func() {
+		for _, trial := range trials {
+			trial.seal()
+		}
+	}()
+	for _, r := range records {
+		if _, ok := producers[r.topic]; ok {
+			continue
+		}
+		producer, trial := producerFor(destination{sink: defaultSinkName, topic: r.topic}, now)
+		if trial != nil {
+			trials[r.topic] = trial
+		}
+		if producer == nil {
+			return http.StatusServiceUnavailable, fmt.Errorf("circuit breaker open for topic %q of sink %q", r.topic, defaultSinkName)
+		}
+		producers[r.topic] = producer
+	}
+
+	headers := requestHeaders(serializer, meta)
+	for _, r := range records {
+		topic := r.topic
+		producer := producers[topic]
+
+		sinkProduced.WithLabelValues(producer.name).Inc()
+		msg := &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Partition: kafka.PartitionAny, Topic: &topic},
+			Key:            r.key,
+			Value:          r.value,
+			Headers:        headers,
+		}
+		trials[topic].track(msg)
+		if err := producer.Produce(msg); err != nil {
+			sinkFailed.WithLabelValues(producer.name).Inc()
+			recordDelivery(producer.name, msg, false)
+			logrus.WithError(err).WithField("sink", producer.name).Error(fmt.Sprintf("couldn't produce alert in kafka topic %v", topic))
+			return http.StatusInternalServerError, fmt.Errorf("couldn't produce alert in kafka topic %v: %s", topic, err)
+		}
+	}
+	return http.StatusOK, nil
+}
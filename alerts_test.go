@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const alertsTestPayload = `{
+  "version": "4",
+  "groupKey": "{}:{alertname=\"HighLatency\"}",
+  "truncatedAlerts": 0,
+  "status": "firing",
+  "receiver": "kafka",
+  "groupLabels": {"alertname": "HighLatency"},
+  "commonLabels": {"alertname": "HighLatency"},
+  "commonAnnotations": {},
+  "externalURL": "http://alertmanager:9093",
+  "alerts": [
+    {
+      "status": "firing",
+      "labels": {"alertname": "HighLatency", "team": "checkout"},
+      "annotations": {"summary": "latency above 1s"},
+      "startsAt": "2022-10-01T10:00:00.5Z",
+      "endsAt": "0001-01-01T00:00:00Z",
+      "generatorURL": "http://prometheus:9090/graph",
+      "fingerprint": "a1b2c3"
+    },
+    {
+      "status": "resolved",
+      "labels": {"alertname": "HighLatency", "team": "search"},
+      "startsAt": "2022-10-01T09:00:00Z",
+      "endsAt": "2022-10-01T09:30:00Z",
+      "fingerprint": "d4e5f6"
+    }
+  ]
+}`
+
+func TestAlertRecords(t *testing.T) {
+	var payload alertmanagerWebhook
+	assert.Nil(t, json.Unmarshal([]byte(alertsTestPayload), &payload))
+
+	defer func(tpl string) { alertsTopicTemplate, _ = parseTopicTemplate(tpl) }(alertsTopic)
+	alertsTopicTemplate, _ = parseTopicTemplate(`alerts.{{ .tenant }}.{{ index . "team" }}`)
+
+	serializer, _ := NewJSONSerializer()
+	records, err := alertRecords(serializer, &payload, "team-a")
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "alerts.team-a.checkout", records[0].topic)
+	assert.Equal(t, "alerts.team-a.search", records[1].topic)
+	assert.Equal(t, []byte("a1b2c3"), records[0].key)
+
+	var alert map[string]interface{}
+	assert.Nil(t, json.Unmarshal(records[0].value, &alert))
+	assert.Equal(t, map[string]interface{}{
+		"status":       "firing",
+		"labels":       map[string]interface{}{"alertname": "HighLatency", "team": "checkout"},
+		"annotations":  map[string]interface{}{"summary": "latency above 1s"},
+		"startsAt":     "2022-10-01T10:00:00.5Z",
+		"endsAt":       "0001-01-01T00:00:00Z",
+		"generatorURL": "http://prometheus:9090/graph",
+		"fingerprint":  "a1b2c3",
+		"groupKey":     `{}:{alertname="HighLatency"}`,
+		"receiver":     "kafka",
+	}, alert)
+
+	avro, err := newAlertSerializer("avro-json")
+	assert.Nil(t, err)
+	records, err = alertRecords(avro, &payload, "")
+	assert.Nil(t, err)
+	assert.Contains(t, string(records[1].value), `"annotations":{}`)
+	assert.Contains(t, string(records[1].value), `"endsAt":"2022-10-01T09:30:00Z"`)
+
+	_, err = newAlertSerializer("xml")
+	assert.Equal(t, errUnknownFormat, err)
+}
+
+func TestProduceAlertsTrial(t *testing.T) {
+	defer func(cb *circuitBreakers) {
+		breakers = cb
+		delete(sinkProducers, defaultSinkName)
+	}(breakers)
+
+	// The half-open breaker lets a single trial request through.
+	breakers = newCircuitBreakers(0.5, 1, time.Minute, 0, 1)
+	breakers.record("test", "alerts", false, time.Now())
+	fake := newFakeProducer(false)
+	sinkProducers[defaultSinkName] = newTestProducer(t, fake)
+
+	serializer, err := newAlertSerializer("json")
+	assert.Nil(t, err)
+	records := []alertRecord{{topic: "alerts", value: []byte("a")}, {topic: "alerts", value: []byte("b")}, {topic: "alerts", value: []byte("c")}}
+	status, err := produceAlerts(serializer, records, requestMeta{}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status, "a notification is a single trial, whatever its number of alerts")
+	assert.Len(t, fake.produced, 3)
+
+	status, _ = produceAlerts(serializer, records, requestMeta{}, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, status, "the trial is pending")
+	assert.Len(t, fake.produced, 3, "rejected notifications produce nothing")
+}
@@ -0,0 +1,392 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// identityKey is the gin context key holding the authenticated identity.
+const identityKey = "identity"
+
+// identity is the result of authenticating a request.
+type identity struct {
+	principal string
+	// tenant is the tenant asserted by the credentials, if any.
+	tenant string
+	// topics are the topic patterns the credentials allow writing to, nil
+	// meaning no restriction.
+	topics []string
+}
+
+// requestIdentity returns the authenticated identity of a request, nil when
+// authentication is disabled.
+func requestIdentity(c *gin.Context) *identity {
+	id, _ := c.Get(identityKey)
+	i, _ := id.(*identity)
+	return i
+}
+
+// Reasons for authentication and authorization failures, used in the
+// auth_failures_total metric.
+const (
+	reasonMissingCredentials = "missing_credentials"
+	reasonUnknownUser        = "unknown_user"
+	reasonInvalidPassword    = "invalid_password"
+	reasonInvalidToken       = "invalid_token"
+	reasonInvalidJWT         = "invalid_jwt"
+	reasonForbiddenTopic     = "forbidden_topic"
+	reasonForbiddenTenant    = "forbidden_tenant"
+)
+
+// authenticator authenticates requests against the configured basic auth
+// accounts, htpasswd file, bearer tokens and client certificates.
+type authenticator struct {
+	mu sync.RWMutex
+	// htpasswd maps users to their bcrypt password hash.
+	htpasswd map[string][]byte
+	// tokens maps the sha256 of every bearer token to its principal.
+	tokens map[[sha256.Size]byte]string
+	// topics maps principals to the topic patterns they may write to.
+	topics map[string][]string
+	// tenants maps principals to the tenant patterns they may write as.
+	tenants map[string][]string
+	// verified caches the sha256 of the last password verified for each
+	// htpasswd user, bcrypt being too slow to run on every request.
+	verified map[string][sha256.Size]byte
+	// jwt validates the JWT bearer tokens, nil when disabled.
+	jwt *jwtValidator
+}
+
+var requestAuth = newAuthenticator()
+
+func newAuthenticator() *authenticator {
+	return &authenticator{
+		htpasswd: map[string][]byte{},
+		tokens:   map[[sha256.Size]byte]string{},
+		topics:   map[string][]string{},
+		tenants:  map[string][]string{},
+		verified: map[string][sha256.Size]byte{},
+	}
+}
+
+// enabled reports whether any kind of authentication is configured.
+func (a *authenticator) enabled() bool {
+	return basicauth || htpasswdFile != "" || bearerTokensFile != "" || tlsClientCAFile != "" || jwtJWKSFile != ""
+}
+
+// middleware rejects the requests that can't be authenticated, storing the
+// identity of the others in the gin context.
+func (a *authenticator) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, reason := a.authenticate(c.Request)
+		if reason != "" {
+			authFailures.WithLabelValues(reason).Inc()
+			logrus.WithField("reason", reason).Warn("authentication failed")
+			c.Header("WWW-Authenticate", `Basic realm="Authorization Required"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Set(identityKey, id)
+		c.Next()
+	}
+}
+
+// authenticate returns the identity of a request, or the reason why it
+// couldn't be authenticated.
+func (a *authenticator) authenticate(req *http.Request) (*identity, string) {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return a.authenticateToken(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	if user, password, ok := req.BasicAuth(); ok {
+		return a.authenticateBasic(user, password)
+	}
+
+	if principal := clientCertPrincipal(req); principal != "" {
+		return &identity{principal: principal}, ""
+	}
+	return nil, reasonMissingCredentials
+}
+
+func (a *authenticator) authenticateToken(token string) (*identity, string) {
+	a.mu.RLock()
+	principal, ok := a.tokens[sha256.Sum256([]byte(token))]
+	jwt := a.jwt
+	a.mu.RUnlock()
+
+	if ok {
+		return &identity{principal: principal}, ""
+	}
+	if jwt == nil || strings.Count(token, ".") != 2 {
+		return nil, reasonInvalidToken
+	}
+
+	claims, err := jwt.validate(token, time.Now())
+	if err != nil {
+		logrus.WithError(err).Debug("invalid JWT")
+		return nil, reasonInvalidJWT
+	}
+	return &identity{principal: claims.principal, tenant: claims.tenant, topics: claims.topics}, ""
+}
+
+func (a *authenticator) authenticateBasic(user, password string) (*identity, string) {
+	if basicauth && user == basicauthUsername {
+		if subtle.ConstantTimeCompare([]byte(password), []byte(basicauthPassword.Value())) != 1 {
+			return nil, reasonInvalidPassword
+		}
+		return &identity{principal: user}, ""
+	}
+
+	a.mu.RLock()
+	hash, ok := a.htpasswd[user]
+	verified, cached := a.verified[user]
+	a.mu.RUnlock()
+
+	if !ok {
+		return nil, reasonUnknownUser
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	if cached && subtle.ConstantTimeCompare(sum[:], verified[:]) == 1 {
+		return &identity{principal: user}, ""
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return nil, reasonInvalidPassword
+	}
+
+	a.mu.Lock()
+	a.verified[user] = sum
+	a.mu.Unlock()
+	return &identity{principal: user}, ""
+}
+
+// authorizeTopic checks whether an identity may write to a topic, both the
+// authorization file and the credentials themselves can restrict the topics.
+// Unauthenticated requests may write to any topic.
+func (a *authenticator) authorizeTopic(id *identity, topic string) bool {
+	if id == nil {
+		return true
+	}
+	if id.topics != nil && !matchPatterns(id.topics, topic) {
+		return false
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	patterns, ok := a.topics[id.principal]
+	return !ok || matchPatterns(patterns, topic)
+}
+
+// authorizeTenant checks whether an identity may write as a tenant. A tenant
+// asserted by the credentials is the only one they may write as, otherwise
+// principals may write as themselves and as the tenants the authorization
+// file grants them. Unauthenticated requests may write as any tenant.
+func (a *authenticator) authorizeTenant(id *identity, tenant string) bool {
+	if id == nil {
+		return true
+	}
+	if id.tenant != "" {
+		return tenant == id.tenant
+	}
+	if tenant == id.principal {
+		return true
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return matchPatterns(a.tenants[id.principal], tenant)
+}
+
+func matchPatterns(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// reload reads again all the credential files.
+func (a *authenticator) reload() error {
+	if err := basicauthPassword.reload(); err != nil {
+		return err
+	}
+
+	htpasswd := map[string][]byte{}
+	if htpasswdFile != "" {
+		var err error
+		if htpasswd, err = loadHtpasswd(htpasswdFile); err != nil {
+			return err
+		}
+	}
+
+	tokens := map[[sha256.Size]byte]string{}
+	if bearerTokensFile != "" {
+		var err error
+		if tokens, err = loadBearerTokens(bearerTokensFile); err != nil {
+			return err
+		}
+	}
+
+	topics, tenants := map[string][]string{}, map[string][]string{}
+	if authorizationFile != "" {
+		var err error
+		if topics, tenants, err = loadAuthorization(authorizationFile); err != nil {
+			return err
+		}
+	}
+
+	a.mu.RLock()
+	jwt := a.jwt
+	a.mu.RUnlock()
+	if jwtJWKSFile != "" {
+		if jwt == nil {
+			jwt = &jwtValidator{}
+		}
+		if err := jwt.reload(); err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.jwt = jwt
+	a.htpasswd = htpasswd
+	a.tokens = tokens
+	a.topics = topics
+	a.tenants = tenants
+	a.verified = map[string][sha256.Size]byte{}
+	return nil
+}
+
+// files returns the credential files in use.
+func (a *authenticator) files() []string {
+	files := secretFiles(basicauthPassword)
+	for _, f := range []string{htpasswdFile, bearerTokensFile, authorizationFile, jwtJWKSFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// loadHtpasswd reads an htpasswd file, only bcrypt hashes are supported.
+func loadHtpasswd(file string) (map[string][]byte, error) {
+	entries, err := readCredentialLines(file)
+	if err != nil {
+		return nil, err
+	}
+
+	htpasswd := make(map[string][]byte, len(entries))
+	for user, hash := range entries {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid htpasswd entry for user %q, only bcrypt is supported: %s", user, err)
+		}
+		htpasswd[user] = []byte(hash)
+	}
+	return htpasswd, nil
+}
+
+// loadBearerTokens reads a file of <principal>:<token> lines.
+func loadBearerTokens(file string) (map[[sha256.Size]byte]string, error) {
+	entries, err := readCredentialLines(file)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[[sha256.Size]byte]string, len(entries))
+	for principal, token := range entries {
+		tokens[sha256.Sum256([]byte(token))] = principal
+	}
+	return tokens, nil
+}
+
+// loadAuthorization reads a YAML file mapping principals to the topic
+// patterns they may write to and the tenant patterns they may write as.
+// Principals without topics may write to any topic.
+func loadAuthorization(file string) (map[string][]string, map[string][]string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var principals map[string]struct {
+		Topics  []string `yaml:"topics"`
+		Tenants []string `yaml:"tenants"`
+	}
+	if err := yaml.UnmarshalStrict(content, &principals); err != nil {
+		return nil, nil, err
+	}
+
+	topics := make(map[string][]string, len(principals))
+	tenants := make(map[string][]string, len(principals))
+	for principal, p := range principals {
+		for _, pattern := range append(p.Topics, p.Tenants...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, nil, fmt.Errorf("invalid pattern %q for principal %q: %s", pattern, principal, err)
+			}
+		}
+		if p.Topics != nil {
+			topics[principal] = p.Topics
+		}
+		tenants[principal] = p.Tenants
+	}
+	return topics, tenants, nil
+}
+
+// readCredentialLines reads a file of <name>:<secret> lines, ignoring empty
+// lines and comments.
+func readCredentialLines(file string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s:%d: malformed line, expected <name>:<secret>", file, n)
+		}
+		if _, ok := entries[parts[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicated entry for %q", file, n, parts[0])
+		}
+		entries[parts[0]] = parts[1]
+	}
+	return entries, scanner.Err()
+}
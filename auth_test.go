@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticator(t *testing.T) {
+	dir := t.TempDir()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.Nil(t, err)
+	htpasswdFile = filepath.Join(dir, "htpasswd")
+	bearerTokensFile = filepath.Join(dir, "tokens")
+	authorizationFile = filepath.Join(dir, "authorization.yaml")
+	defer func() { htpasswdFile, bearerTokensFile, authorizationFile = "", "", "" }()
+
+	assert.Nil(t, ioutil.WriteFile(htpasswdFile, []byte("alice:"+string(hash)+"\n"), 0600))
+	assert.Nil(t, ioutil.WriteFile(bearerTokensFile, []byte("# agents\nbob:s3cr3t-t0k3n\n"), 0600))
+	assert.Nil(t, ioutil.WriteFile(authorizationFile, []byte("bob: {topics: ['metrics.bob.*'], tenants: ['team-*']}\ncarol: {tenants: [ops]}\n"), 0600))
+
+	a := newAuthenticator()
+	assert.Nil(t, a.reload())
+
+	request := func(setup func(*http.Request)) (string, string) {
+		req, _ := http.NewRequest(http.MethodPost, "/receive", nil)
+		setup(req)
+		id, reason := a.authenticate(req)
+		if id == nil {
+			return "", reason
+		}
+		return id.principal, reason
+	}
+
+	for i := 0; i < 2; i++ {
+		principal, reason := request(func(r *http.Request) { r.SetBasicAuth("alice", "secret") })
+		assert.Equal(t, "alice", principal)
+		assert.Empty(t, reason)
+	}
+
+	_, reason := request(func(r *http.Request) { r.SetBasicAuth("alice", "wrong") })
+	assert.Equal(t, reasonInvalidPassword, reason)
+	_, reason = request(func(r *http.Request) { r.SetBasicAuth("carol", "secret") })
+	assert.Equal(t, reasonUnknownUser, reason)
+	_, reason = request(func(r *http.Request) {})
+	assert.Equal(t, reasonMissingCredentials, reason)
+
+	principal, reason := request(func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cr3t-t0k3n") })
+	assert.Equal(t, "bob", principal)
+	assert.Empty(t, reason)
+	_, reason = request(func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") })
+	assert.Equal(t, reasonInvalidToken, reason)
+
+	assert.True(t, a.authorizeTopic(&identity{principal: "bob"}, "metrics.bob.up"))
+	assert.False(t, a.authorizeTopic(&identity{principal: "bob"}, "metrics.alice.up"))
+	assert.True(t, a.authorizeTopic(&identity{principal: "alice"}, "metrics.bob.up"))
+	assert.False(t, a.authorizeTopic(&identity{principal: "alice", topics: []string{"other"}}, "metrics.bob.up"))
+	assert.True(t, a.authorizeTopic(&identity{principal: "carol"}, "metrics.bob.up"))
+
+	assert.True(t, a.authorizeTenant(&identity{principal: "bob"}, "bob"))
+	assert.True(t, a.authorizeTenant(&identity{principal: "bob"}, "team-a"))
+	assert.False(t, a.authorizeTenant(&identity{principal: "bob"}, "ops"))
+	assert.False(t, a.authorizeTenant(&identity{principal: "alice"}, "team-a"))
+	assert.False(t, a.authorizeTenant(&identity{principal: "bob", tenant: "team-a"}, "team-b"))
+	assert.True(t, a.authorizeTenant(nil, "team-a"))
+
+	assert.Nil(t, os.Remove(bearerTokensFile))
+	assert.NotNil(t, a.reload(), "failed reloads are reported")
+}
+
+func TestTenantFromRequest(t *testing.T) {
+	authorizationFile = filepath.Join(t.TempDir(), "authorization.yaml")
+	defer func(a *authenticator) { authorizationFile, requestAuth = "", a }(requestAuth)
+	assert.Nil(t, ioutil.WriteFile(authorizationFile, []byte("bob: {tenants: [team-b]}\n"), 0600))
+	requestAuth = newAuthenticator()
+	assert.Nil(t, requestAuth.reload())
+
+	tenant := func(id *identity, header string) (string, error) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest(http.MethodPost, "/receive", nil)
+		if header != "" {
+			c.Request.Header.Set(tenantHeader, header)
+		}
+		if id != nil {
+			c.Set(identityKey, id)
+		}
+		return tenantFromRequest(c)
+	}
+
+	result, err := tenant(&identity{principal: "alice", tenant: "team-a"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "team-a", result)
+	result, err = tenant(&identity{principal: "alice", tenant: "team-a"}, "team-a")
+	assert.Nil(t, err)
+	assert.Equal(t, "team-a", result)
+	result, err = tenant(&identity{principal: "alice"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", result)
+	result, err = tenant(&identity{principal: "bob"}, "team-b")
+	assert.Nil(t, err)
+	assert.Equal(t, "team-b", result)
+	result, err = tenant(nil, "team-b")
+	assert.Nil(t, err)
+	assert.Equal(t, "team-b", result)
+
+	// Credentials of a tenant can't write as another one.
+	_, err = tenant(&identity{principal: "alice", tenant: "team-a"}, "team-b")
+	assert.IsType(t, &forbiddenTenantError{}, err)
+	_, err = tenant(&identity{principal: "alice"}, "team-b")
+	assert.IsType(t, &forbiddenTenantError{}, err)
+	_, err = tenant(&identity{principal: "bob"}, "team-c")
+	assert.IsType(t, &forbiddenTenantError{}, err)
+}
@@ -0,0 +1,262 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+)
+
+// Circuit breaker states, as exported by kafka_circuit_breaker_state.
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStateNames = []string{"closed", "open", "half-open"}
+
+// breakerKey identifies the breaker of a topic of a sink.
+type breakerKey struct {
+	sink  string
+	topic string
+}
+
+// breaker tracks the produce and delivery outcomes of a topic of a sink.
+type breaker struct {
+	state       int
+	windowStart time.Time
+	successes   int
+	failures    int
+	openedAt    time.Time
+	trials      int
+}
+
+// circuitBreakers stops sending messages to the topics failing too often.
+// A breaker opens when the failure ratio of the messages of a window reaches
+// the threshold, rejecting messages until the open timeout. It then lets a
+// few trial requests through, closing on as many successful requests and
+// opening again on the first failed one.
+type circuitBreakers struct {
+	failureRatio     float64
+	minRequests      int
+	window           time.Duration
+	openTimeout      time.Duration
+	halfOpenRequests int
+
+	mu       sync.Mutex
+	breakers map[breakerKey]*breaker
+}
+
+func newCircuitBreakers(failureRatio float64, minRequests int, window, openTimeout time.Duration, halfOpenRequests int) *circuitBreakers {
+	return &circuitBreakers{
+		failureRatio:     failureRatio,
+		minRequests:      minRequests,
+		window:           window,
+		openTimeout:      openTimeout,
+		halfOpenRequests: halfOpenRequests,
+		breakers:         map[breakerKey]*breaker{},
+	}
+}
+
+func (cb *circuitBreakers) get(key breakerKey, now time.Time) *breaker {
+	b, ok := cb.breakers[key]
+	if !ok {
+		b = &breaker{windowStart: now}
+		cb.breakers[key] = b
+		circuitBreakerState.WithLabelValues(key.sink, key.topic).Set(breakerClosed)
+	}
+	return b
+}
+
+// allow tells whether a request may produce to a topic of a sink. Requests
+// let through a half-open breaker get a trial, which must track their
+// messages and be sealed once they are produced.
+func (cb *circuitBreakers) allow(sink, topic string, now time.Time) (bool, *breakerTrial) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	key := breakerKey{sink, topic}
+	b := cb.get(key, now)
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < cb.openTimeout {
+			return false, nil
+		}
+		cb.transition(key, b, breakerHalfOpen, now)
+		fallthrough
+	case breakerHalfOpen:
+		if b.trials >= cb.halfOpenRequests {
+			return false, nil
+		}
+		b.trials++
+		return true, &breakerTrial{cb: cb, key: key, halfOpenedAt: b.windowStart, pending: 1}
+	}
+	return true, nil
+}
+
+// record accounts the outcome of a message produced to a topic of a sink.
+// Only closed breakers account messages, half-open ones account the outcome
+// of their trials.
+func (cb *circuitBreakers) record(sink, topic string, success bool, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	key := breakerKey{sink, topic}
+	b := cb.get(key, now)
+	if b.state != breakerClosed {
+		return
+	}
+	if now.Sub(b.windowStart) >= cb.window {
+		b.windowStart, b.successes, b.failures = now, 0, 0
+	}
+	if success {
+		b.successes++
+		return
+	}
+	b.failures++
+	total := b.successes + b.failures
+	if total >= cb.minRequests && float64(b.failures)/float64(total) >= cb.failureRatio {
+		cb.transition(key, b, breakerOpen, now)
+	}
+}
+
+// recordTrial accounts the outcome of a trial request. Trials of an earlier
+// half-open period are ignored, as are the trials that produced nothing,
+// which give their place to another request.
+func (cb *circuitBreakers) recordTrial(t *breakerTrial, produced, success bool, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	b := cb.get(t.key, now)
+	if b.state != breakerHalfOpen || !b.windowStart.Equal(t.halfOpenedAt) {
+		return
+	}
+	switch {
+	case !produced:
+		b.trials--
+	case !success:
+		cb.transition(t.key, b, breakerOpen, now)
+	default:
+		b.successes++
+		if b.successes >= cb.halfOpenRequests {
+			cb.transition(t.key, b, breakerClosed, now)
+		}
+	}
+}
+
+// breakerTrial gathers the messages of a request let through a half-open
+// breaker, which count as a single outcome: a failure as soon as one of them
+// fails, a success once all of them are delivered.
+type breakerTrial struct {
+	cb           *circuitBreakers
+	key          breakerKey
+	halfOpenedAt time.Time
+
+	mu sync.Mutex
+	// pending counts the messages not delivered yet, plus one until the
+	// trial is sealed.
+	pending  int
+	messages int
+	done     bool
+}
+
+// track makes a message part of the trial, if any.
+func (t *breakerTrial) track(msg *kafka.Message) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.pending++
+	t.messages++
+	t.mu.Unlock()
+	msg.Opaque = t
+}
+
+// seal tells that the request produced all its messages, if any.
+func (t *breakerTrial) seal() {
+	if t != nil {
+		t.complete(true)
+	}
+}
+
+// complete accounts the delivery of a message, or the sealing of the trial,
+// and records the outcome of the trial once it is known.
+func (t *breakerTrial) complete(success bool) {
+	t.mu.Lock()
+	t.pending--
+	if t.done || (success && t.pending > 0) {
+		t.mu.Unlock()
+		return
+	}
+	t.done = true
+	produced := t.messages > 0
+	t.mu.Unlock()
+
+	t.cb.recordTrial(t, produced, success, time.Now())
+}
+
+func (cb *circuitBreakers) transition(key breakerKey, b *breaker, state int, now time.Time) {
+	b.state = state
+	b.windowStart, b.successes, b.failures, b.trials = now, 0, 0, 0
+	if state == breakerOpen {
+		b.openedAt = now
+	}
+
+	circuitBreakerState.WithLabelValues(key.sink, key.topic).Set(float64(state))
+	circuitBreakerTransitions.WithLabelValues(key.sink, key.topic, breakerStateNames[state]).Inc()
+	entry := logrus.WithFields(logrus.Fields{"sink": key.sink, "topic": key.topic, "state": breakerStateNames[state]})
+	if state == breakerOpen {
+		entry.Warn("circuit breaker opened")
+	} else {
+		entry.Info("circuit breaker state changed")
+	}
+}
+
+// recordDelivery accounts the outcome of a message when circuit breakers are
+// enabled, the messages of trial requests being accounted by their trial.
+func recordDelivery(sink string, msg *kafka.Message, success bool) {
+	if trial, ok := msg.Opaque.(*breakerTrial); ok {
+		msg.Opaque = nil
+		trial.complete(success)
+		return
+	}
+	if breakers != nil {
+		breakers.record(sink, *msg.TopicPartition.Topic, success, time.Now())
+	}
+}
+
+// producerFor returns the producer a request should use for a destination,
+// along with the trial the request is when its breaker is half-open. When the
+// breaker of the sink is open the standby is used if the sink has one,
+// otherwise nil is returned and the request must fail fast.
+func producerFor(d destination, now time.Time) (*reloadableProducer, *breakerTrial) {
+	target := sinkTarget(d.sink)
+	if breakers == nil {
+		return target, nil
+	}
+	if ok, trial := breakers.allow(target.name, d.topic, now); ok {
+		return target, trial
+	}
+	if f, ok := failovers[d.sink]; ok && target == f.primary {
+		if ok, trial := breakers.allow(f.standby.name, d.topic, now); ok {
+			return f.standby, trial
+		}
+	}
+	return nil, nil
+}
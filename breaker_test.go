@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	cb := newCircuitBreakers(0.5, 4, time.Minute, 30*time.Second, 2)
+	cb.record("default", "metrics", true, now)
+	cb.record("default", "metrics", false, now)
+	cb.record("default", "metrics", false, now)
+	ok, _ := cb.allow("default", "metrics", now)
+	assert.True(t, ok, "too few requests to open")
+
+	cb.record("default", "metrics", false, now)
+	ok, _ = cb.allow("default", "metrics", now)
+	assert.False(t, ok)
+	ok, _ = cb.allow("default", "other", now)
+	assert.True(t, ok, "topics have their own breakers")
+
+	later := now.Add(30 * time.Second)
+	ok, first := cb.allow("default", "metrics", later)
+	assert.True(t, ok)
+	ok, second := cb.allow("default", "metrics", later)
+	assert.True(t, ok)
+	ok, _ = cb.allow("default", "metrics", later)
+	assert.False(t, ok, "half-open breakers only let a few requests through")
+
+	// Trials producing nothing give their place to another request.
+	second.seal()
+	ok, second = cb.allow("default", "metrics", later)
+	assert.True(t, ok)
+	second.seal()
+
+	failed := &kafka.Message{}
+	first.track(failed)
+	first.seal()
+	recordDelivery("default", failed, false)
+	assert.Equal(t, breakerOpen, cb.breakers[breakerKey{"default", "metrics"}].state, "a failure opens the breaker again")
+}
+
+func TestCircuitBreakerTrials(t *testing.T) {
+	// Trials record their outcome at the time it is known.
+	now := time.Now()
+	cb := newCircuitBreakers(0.5, 1, time.Minute, 30*time.Second, 2)
+	cb.record("default", "metrics", false, now)
+	later := now.Add(30 * time.Second)
+
+	// Every trial request counts once, whatever its number of messages.
+	trial := func() ([]*kafka.Message, *breakerTrial) {
+		ok, trial := cb.allow("default", "metrics", later)
+		assert.True(t, ok)
+		assert.NotNil(t, trial)
+		msgs := []*kafka.Message{{}, {}, {}}
+		for _, msg := range msgs {
+			trial.track(msg)
+		}
+		trial.seal()
+		return msgs, trial
+	}
+	first, _ := trial()
+	second, _ := trial()
+	for _, msg := range first {
+		recordDelivery("default", msg, true)
+	}
+	ok, _ := cb.allow("default", "metrics", later)
+	assert.False(t, ok, "a successful trial doesn't close the breaker alone")
+	recordDelivery("default", second[0], true)
+	recordDelivery("default", second[1], true)
+	ok, _ = cb.allow("default", "metrics", later)
+	assert.False(t, ok, "trials succeed once all their messages are delivered")
+	recordDelivery("default", second[2], true)
+	ok, trial3 := cb.allow("default", "metrics", later)
+	assert.True(t, ok)
+	assert.Nil(t, trial3, "closed after as many successful trials")
+
+	// The first failed message of a trial opens the breaker, the pending
+	// trials being ignored afterwards.
+	cb.record("default", "metrics", false, later)
+	later = later.Add(30 * time.Second)
+	failing, _ := trial()
+	stale, _ := trial()
+	recordDelivery("default", failing[0], true)
+	recordDelivery("default", failing[1], false)
+	assert.Equal(t, breakerOpen, cb.breakers[breakerKey{"default", "metrics"}].state)
+
+	later = time.Now().Add(30 * time.Second)
+	fresh, _ := trial()
+	for _, msg := range append(stale, fresh...) {
+		recordDelivery("default", msg, true)
+	}
+	ok, trial4 := cb.allow("default", "metrics", later)
+	assert.True(t, ok)
+	assert.NotNil(t, trial4, "trials of an earlier half-open period are ignored")
+}
@@ -15,14 +15,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	"gopkg.in/yaml.v2"
 	"os"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/sirupsen/logrus"
 )
 
@@ -33,18 +37,95 @@ var (
 	match                  = make(map[string]*dto.MetricFamily, 0)
 	basicauth              = false
 	basicauthUsername      = ""
-	basicauthPassword      = ""
+	basicauthPassword      = &secret{}
 	kafkaCompression       = "none"
 	kafkaBatchNumMessages  = "10000"
 	kafkaSslClientCertFile = ""
 	kafkaSslClientKeyFile  = ""
-	kafkaSslClientKeyPass  = ""
+	kafkaSslClientKeyPass  = &secret{}
 	kafkaSslCACertFile     = ""
 	kafkaSecurityProtocol  = ""
 	kafkaSaslMechanism     = ""
 	kafkaSaslUsername      = ""
-	kafkaSaslPassword      = ""
+	kafkaSaslPassword      = &secret{}
 	serializer             Serializer
+	kafkaHeaders           = []string{}
+	kafkaStaticHeaders     = []kafka.Header{}
+	kafkaLabelHeaders      = []labelHeader{}
+	instanceID, _          = os.Hostname()
+	tenantHeader           = "X-Scope-OrgID"
+	tenantRequired         = false
+	defaultTenant          = ""
+	tenantConfig           = map[string]*tenantOverrides{}
+	tenantOverridesFile    = ""
+	defaultLimits          = tenantLimits{}
+	activeSeriesTimeout    = 10 * time.Minute
+	configReloadInterval   = 30 * time.Second
+	haDedup                *haTracker
+	htpasswdFile           = ""
+	bearerTokensFile       = ""
+	authorizationFile      = ""
+	tlsCertFile            = ""
+	tlsKeyFile             = ""
+	tlsClientCAFile        = ""
+	tlsClientAuth          = clientAuthRequire
+	tlsClientPrincipal     = "cn"
+	jwtJWKSFile            = ""
+	jwtIssuer              = ""
+	jwtAudience            = ""
+	jwtPrincipalClaim      = "sub"
+	jwtTenantClaim         = "tenant"
+	jwtTopicsClaim         = "topics"
+	jwtLeeway              = time.Minute
+
+	// OAUTHBEARER settings, either librdkafka's oidc method or a token file
+	// or command refreshed by the adapter.
+	kafkaOAuthBearerMethod           = "default"
+	kafkaOAuthBearerClientID         = ""
+	kafkaOAuthBearerClientSecret     = &secret{}
+	kafkaOAuthBearerTokenEndpointURL = ""
+	kafkaOAuthBearerScope            = ""
+	kafkaOAuthBearerExtensions       = map[string]string{}
+	kafkaOAuthBearerTokenFile        = ""
+	kafkaOAuthBearerTokenCommand     = ""
+	kafkaOAuthBearerTokenLifetime    = time.Hour
+	kafkaOAuthBearerPrincipal        = ""
+
+	// Time given to a replaced producer to deliver its queued messages.
+	kafkaProducerDrainTimeout = 30 * time.Second
+
+	// Additional kafka clusters and the routing table.
+	sinksFilePath = ""
+	breakers      *circuitBreakers
+
+	// Remote write endpoints the samples are forwarded to.
+	forwardFilePath = ""
+
+	// Endpoints in exposition format scraped periodically.
+	federateFilePath = ""
+
+	// Graphite listeners, disabled unless their address is set.
+	graphiteListenAddress       = ""
+	graphitePickleListenAddress = ""
+	graphiteMappingFile         = ""
+	graphiteTenant              = ""
+	graphiteMaxConnections      = 100
+	graphiteMaxLineLength       = 4096
+	graphiteIdleTimeout         = 5 * time.Minute
+
+	// Alerts received from the Alertmanager webhook.
+	alertsTopic         = "alerts"
+	alertsTopicTemplate *template.Template
+	alertsSerializer    Serializer
+	alertsFormat        = "json"
+
+	// Remote read buffer, disabled unless the samples kept per series are
+	// set.
+	remoteReadSamplesPerSeries = 0
+	remoteReadMaxSeries        = 100000
+	remoteReadSeedTopics       []string
+	remoteReadSeedLookback     = time.Hour
+	remoteReadSeedTimeout      = 5 * time.Minute
 )
 
 func init() {
@@ -68,8 +149,80 @@ func init() {
 		basicauthUsername = value
 	}
 
-	if value := os.Getenv("BASIC_AUTH_PASSWORD"); value != "" {
-		basicauthPassword = value
+	basicauthPassword = parseSecret("BASIC_AUTH_PASSWORD")
+
+	if value := os.Getenv("BASIC_AUTH_HTPASSWD_FILE"); value != "" {
+		htpasswdFile = value
+	}
+
+	if value := os.Getenv("BEARER_TOKENS_FILE"); value != "" {
+		bearerTokensFile = value
+	}
+
+	if value := os.Getenv("AUTHORIZATION_FILE"); value != "" {
+		authorizationFile = value
+	}
+
+	if value := os.Getenv("JWT_JWKS_FILE"); value != "" {
+		jwtJWKSFile = value
+	}
+
+	if value := os.Getenv("JWT_ISSUER"); value != "" {
+		jwtIssuer = value
+	}
+
+	if value := os.Getenv("JWT_AUDIENCE"); value != "" {
+		jwtAudience = value
+	}
+
+	if value := os.Getenv("JWT_PRINCIPAL_CLAIM"); value != "" {
+		jwtPrincipalClaim = value
+	}
+
+	if value := os.Getenv("JWT_TENANT_CLAIM"); value != "" {
+		jwtTenantClaim = value
+	}
+
+	if value := os.Getenv("JWT_TOPICS_CLAIM"); value != "" {
+		jwtTopicsClaim = value
+	}
+
+	if value := os.Getenv("JWT_LEEWAY"); value != "" {
+		jwtLeeway = parseDuration("JWT_LEEWAY", value)
+	}
+
+	if value := os.Getenv("TLS_CERT_FILE"); value != "" {
+		tlsCertFile = value
+	}
+
+	if value := os.Getenv("TLS_KEY_FILE"); value != "" {
+		tlsKeyFile = value
+	}
+
+	if value := os.Getenv("TLS_CLIENT_CA_FILE"); value != "" {
+		tlsClientCAFile = value
+	}
+
+	if value := os.Getenv("TLS_CLIENT_AUTH"); value != "" {
+		if value != clientAuthRequire && value != clientAuthVerifyIfGiven {
+			logrus.WithField("TLS_CLIENT_AUTH", value).Fatalln("invalid tls client auth mode")
+		}
+		tlsClientAuth = value
+	}
+
+	if value := os.Getenv("TLS_CLIENT_PRINCIPAL"); value != "" {
+		if value != "cn" && value != "san" {
+			logrus.WithField("TLS_CLIENT_PRINCIPAL", value).Fatalln("invalid tls client principal, must be cn or san")
+		}
+		tlsClientPrincipal = value
+	}
+
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		logrus.Fatalln("invalid config: both TLS_CERT_FILE and TLS_KEY_FILE must be provided")
+	}
+
+	if tlsClientCAFile != "" && tlsCertFile == "" {
+		logrus.Fatalln("invalid config: TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
 	}
 
 	if value := os.Getenv("KAFKA_COMPRESSION"); value != "" {
@@ -88,9 +241,7 @@ func init() {
 		kafkaSslClientKeyFile = value
 	}
 
-	if value := os.Getenv("KAFKA_SSL_CLIENT_KEY_PASS"); value != "" {
-		kafkaSslClientKeyPass = value
-	}
+	kafkaSslClientKeyPass = parseSecret("KAFKA_SSL_CLIENT_KEY_PASS")
 
 	if value := os.Getenv("KAFKA_SSL_CA_CERT_FILE"); value != "" {
 		kafkaSslCACertFile = value
@@ -108,8 +259,241 @@ func init() {
 		kafkaSaslUsername = value
 	}
 
-	if value := os.Getenv("KAFKA_SASL_PASSWORD"); value != "" {
-		kafkaSaslPassword = value
+	kafkaSaslPassword = parseSecret("KAFKA_SASL_PASSWORD")
+
+	if value := os.Getenv("KAFKA_HEADERS"); value != "" {
+		headers, err := parseHeaderList(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the kafka headers")
+		}
+		kafkaHeaders = headers
+	}
+
+	if value := os.Getenv("KAFKA_STATIC_HEADERS"); value != "" {
+		headers, err := parseStaticHeaders(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the kafka static headers")
+		}
+		kafkaStaticHeaders = headers
+	}
+
+	if value := os.Getenv("KAFKA_LABEL_HEADERS"); value != "" {
+		headers, err := parseLabelHeaders(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the kafka label headers")
+		}
+		kafkaLabelHeaders = headers
+	}
+
+	if value := os.Getenv("INSTANCE_ID"); value != "" {
+		instanceID = value
+	}
+
+	if value := os.Getenv("TENANT_HEADER"); value != "" {
+		tenantHeader = value
+	}
+
+	if value := os.Getenv("TENANT_REQUIRED"); value != "" {
+		tenantRequired = value == "true"
+	}
+
+	if value := os.Getenv("DEFAULT_TENANT"); value != "" {
+		if err := validateTenant(value); err != nil {
+			logrus.WithError(err).Fatalln("invalid default tenant")
+		}
+		defaultTenant = value
+	}
+
+	if value := os.Getenv("TENANT_OVERRIDES_FILE"); value != "" {
+		overrides, err := loadTenantOverrides(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't load the tenant overrides")
+		}
+		tenantConfig = overrides
+		tenantOverridesFile = value
+	}
+
+	if value := os.Getenv("INGESTION_RATE_LIMIT"); value != "" {
+		defaultLimits.IngestionRate = parseFloat("INGESTION_RATE_LIMIT", value)
+	}
+
+	if value := os.Getenv("INGESTION_BURST_SIZE"); value != "" {
+		defaultLimits.IngestionBurstSize = parseInt("INGESTION_BURST_SIZE", value)
+	}
+
+	if value := os.Getenv("INGESTION_BYTES_RATE_LIMIT"); value != "" {
+		defaultLimits.IngestionBytesRate = parseFloat("INGESTION_BYTES_RATE_LIMIT", value)
+	}
+
+	if value := os.Getenv("INGESTION_BYTES_BURST_SIZE"); value != "" {
+		defaultLimits.IngestionBytesBurstSize = parseInt("INGESTION_BYTES_BURST_SIZE", value)
+	}
+
+	if value := os.Getenv("MAX_SERIES_PER_TENANT"); value != "" {
+		defaultLimits.MaxSeries = parseInt("MAX_SERIES_PER_TENANT", value)
+	}
+
+	if value := os.Getenv("ACTIVE_SERIES_TIMEOUT"); value != "" {
+		activeSeriesTimeout = parseDuration("ACTIVE_SERIES_TIMEOUT", value)
+		// The inactive series are purged every half timeout.
+		if activeSeriesTimeout < time.Second {
+			logrus.WithField("ACTIVE_SERIES_TIMEOUT", value).Fatalln("invalid active series timeout, must be at least 1s")
+		}
+	}
+
+	if value := os.Getenv("CONFIG_RELOAD_INTERVAL"); value != "" {
+		configReloadInterval = parseDuration("CONFIG_RELOAD_INTERVAL", value)
+	}
+
+	if value := os.Getenv("HA_TRACKER_ENABLED"); value == "true" {
+		clusterLabel, replicaLabel, failoverTimeout := "cluster", "__replica__", 30*time.Second
+		if value := os.Getenv("HA_CLUSTER_LABEL"); value != "" {
+			clusterLabel = value
+		}
+		if value := os.Getenv("HA_REPLICA_LABEL"); value != "" {
+			replicaLabel = value
+		}
+		if value := os.Getenv("HA_FAILOVER_TIMEOUT"); value != "" {
+			failoverTimeout = parseDuration("HA_FAILOVER_TIMEOUT", value)
+		}
+		haDedup = newHATracker(clusterLabel, replicaLabel, failoverTimeout)
+	}
+
+	if value := os.Getenv("CIRCUIT_BREAKER_ENABLED"); value == "true" {
+		failureRatio, minRequests, window, openTimeout, halfOpenRequests := 0.5, 20, time.Minute, 30*time.Second, 5
+		if value := os.Getenv("CIRCUIT_BREAKER_FAILURE_RATIO"); value != "" {
+			failureRatio = parseFloat("CIRCUIT_BREAKER_FAILURE_RATIO", value)
+		}
+		if value := os.Getenv("CIRCUIT_BREAKER_MIN_REQUESTS"); value != "" {
+			minRequests = parseInt("CIRCUIT_BREAKER_MIN_REQUESTS", value)
+		}
+		if value := os.Getenv("CIRCUIT_BREAKER_WINDOW"); value != "" {
+			window = parseDuration("CIRCUIT_BREAKER_WINDOW", value)
+		}
+		if value := os.Getenv("CIRCUIT_BREAKER_OPEN_TIMEOUT"); value != "" {
+			openTimeout = parseDuration("CIRCUIT_BREAKER_OPEN_TIMEOUT", value)
+		}
+		if value := os.Getenv("CIRCUIT_BREAKER_HALF_OPEN_REQUESTS"); value != "" {
+			halfOpenRequests = parseInt("CIRCUIT_BREAKER_HALF_OPEN_REQUESTS", value)
+		}
+		breakers = newCircuitBreakers(failureRatio, minRequests, window, openTimeout, halfOpenRequests)
+	}
+
+	if value := os.Getenv("KAFKA_SASL_OAUTHBEARER_METHOD"); value != "" {
+		value = strings.ToLower(value)
+		if value != "default" && value != "oidc" {
+			logrus.WithField("KAFKA_SASL_OAUTHBEARER_METHOD", value).Fatalln("invalid oauthbearer method, must be default or oidc")
+		}
+		kafkaOAuthBearerMethod = value
+	}
+
+	if value := os.Getenv("KAFKA_SASL_OAUTHBEARER_CLIENT_ID"); value != "" {
+		kafkaOAuthBearerClientID = value
+	}
+
+	kafkaOAuthBearerClientSecret = parseSecret("KAFKA_SASL_OAUTHBEARER_CLIENT_SECRET")
+
+	if value := os.Getenv("KAFKA_SASL_OAUTHBEARER_TOKEN_ENDPOINT_URL"); value != "" {
+		kafkaOAuthBearerTokenEndpointURL = value
+	}
+
+	if value := os.Getenv("KAFKA_SASL_OAUTHBEARER_SCOPE"); value != "" {
+		kafkaOAuthBearerScope = value
+	}
+
+	if value := os.Getenv("KAFKA_SASL_OAUTHBEARER_EXTENSIONS"); value != "" {
+		extensions, err := parseKeyValueList(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the oauthbearer extensions")
+		}
+		kafkaOAuthBearerExtensions = extensions
+	}
+
+	if value := os.Getenv("KAFKA_SASL_OAUTHBEARER_TOKEN_FILE"); value != "" {
+		kafkaOAuthBearerTokenFile = value
+	}
+
+	if value := os.Getenv("KAFKA_SASL_OAUTHBEARER_TOKEN_COMMAND"); value != "" {
+		kafkaOAuthBearerTokenCommand = value
+	}
+
+	if value := os.Getenv("KAFKA_SASL_OAUTHBEARER_TOKEN_LIFETIME"); value != "" {
+		kafkaOAuthBearerTokenLifetime = parseDuration("KAFKA_SASL_OAUTHBEARER_TOKEN_LIFETIME", value)
+	}
+
+	if value := os.Getenv("KAFKA_SASL_OAUTHBEARER_PRINCIPAL"); value != "" {
+		kafkaOAuthBearerPrincipal = value
+	}
+
+	if value := os.Getenv("KAFKA_PRODUCER_DRAIN_TIMEOUT"); value != "" {
+		kafkaProducerDrainTimeout = parseDuration("KAFKA_PRODUCER_DRAIN_TIMEOUT", value)
+	}
+
+	if value := os.Getenv("SINKS_FILE"); value != "" {
+		sinksFilePath = value
+	}
+
+	if value := os.Getenv("REMOTE_WRITE_FORWARD_FILE"); value != "" {
+		forwardFilePath = value
+	}
+
+	if value := os.Getenv("FEDERATE_FILE"); value != "" {
+		federateFilePath = value
+	}
+
+	if value := os.Getenv("GRAPHITE_LISTEN_ADDRESS"); value != "" {
+		graphiteListenAddress = value
+	}
+
+	if value := os.Getenv("GRAPHITE_PICKLE_LISTEN_ADDRESS"); value != "" {
+		graphitePickleListenAddress = value
+	}
+
+	if value := os.Getenv("GRAPHITE_MAPPING_FILE"); value != "" {
+		graphiteMappingFile = value
+	}
+
+	if value := os.Getenv("GRAPHITE_TENANT"); value != "" {
+		if err := validateTenant(value); err != nil {
+			logrus.WithError(err).Fatalln("invalid graphite tenant")
+		}
+		graphiteTenant = value
+	}
+
+	if value := os.Getenv("GRAPHITE_MAX_CONNECTIONS"); value != "" {
+		graphiteMaxConnections = parseInt("GRAPHITE_MAX_CONNECTIONS", value)
+	}
+
+	if value := os.Getenv("GRAPHITE_MAX_LINE_LENGTH"); value != "" {
+		graphiteMaxLineLength = parseInt("GRAPHITE_MAX_LINE_LENGTH", value)
+	}
+
+	if value := os.Getenv("GRAPHITE_IDLE_TIMEOUT"); value != "" {
+		graphiteIdleTimeout = parseDuration("GRAPHITE_IDLE_TIMEOUT", value)
+	}
+
+	if value := os.Getenv("REMOTE_READ_SAMPLES_PER_SERIES"); value != "" {
+		remoteReadSamplesPerSeries = parseInt("REMOTE_READ_SAMPLES_PER_SERIES", value)
+	}
+
+	if value := os.Getenv("REMOTE_READ_MAX_SERIES"); value != "" {
+		remoteReadMaxSeries = parseInt("REMOTE_READ_MAX_SERIES", value)
+	}
+
+	if value := os.Getenv("REMOTE_READ_SEED_TOPICS"); value != "" {
+		for _, topic := range strings.Split(value, ",") {
+			if topic = strings.TrimSpace(topic); topic != "" {
+				remoteReadSeedTopics = append(remoteReadSeedTopics, topic)
+			}
+		}
+	}
+
+	if value := os.Getenv("REMOTE_READ_SEED_LOOKBACK"); value != "" {
+		remoteReadSeedLookback = parseDuration("REMOTE_READ_SEED_LOOKBACK", value)
+	}
+
+	if value := os.Getenv("REMOTE_READ_SEED_TIMEOUT"); value != "" {
+		remoteReadSeedTimeout = parseDuration("REMOTE_READ_SEED_TIMEOUT", value)
 	}
 
 	if value := os.Getenv("MATCH"); value != "" {
@@ -130,6 +514,24 @@ func init() {
 	if err != nil {
 		logrus.WithError(err).Fatalln("couldn't parse the topic template")
 	}
+
+	if value := os.Getenv("ALERTS_TOPIC"); value != "" {
+		alertsTopic = value
+	}
+
+	alertsTopicTemplate, err = parseTopicTemplate(alertsTopic)
+	if err != nil {
+		logrus.WithError(err).Fatalln("couldn't parse the alerts topic template")
+	}
+
+	if value := os.Getenv("ALERTS_SERIALIZATION_FORMAT"); value != "" {
+		alertsFormat = value
+	}
+
+	alertsSerializer, err = newAlertSerializer(alertsFormat)
+	if err != nil {
+		logrus.WithError(err).WithField("ALERTS_SERIALIZATION_FORMAT", alertsFormat).Fatalln("couldn't create the alerts serializer")
+	}
 }
 
 func parseMatchList(text string) (map[string]*dto.MetricFamily, error) {
@@ -138,6 +540,10 @@ func parseMatchList(text string) (map[string]*dto.MetricFamily, error) {
 	if err != nil {
 		return nil, err
 	}
+	return matchRulesToMetricFamilies(matchRules)
+}
+
+func matchRulesToMetricFamilies(matchRules []string) (map[string]*dto.MetricFamily, error) {
 	var metricsList []string
 	for _, v := range matchRules {
 		metricsList = append(metricsList, fmt.Sprintf("%s 0\n", v))
@@ -164,15 +570,88 @@ func parseLogLevel(value string) logrus.Level {
 	return level
 }
 
+// parseKeyValueList parses a comma separated list of key=value pairs.
+func parseKeyValueList(text string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, pair := range strings.Split(text, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("malformed key=value pair %q", pair)
+		}
+		result[kv[0]] = kv[1]
+	}
+	return result, nil
+}
+
+// parseSecret reads a secret from the environment variable name or from the
+// file named by name_FILE.
+func parseSecret(name string) *secret {
+	s, err := newSecret(name)
+	if err != nil {
+		logrus.WithError(err).Fatalln("couldn't read secret")
+	}
+	return s
+}
+
+func parseInt(name, value string) int {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		logrus.WithError(err).WithField(name, value).Fatalln("couldn't parse integer")
+	}
+	return i
+}
+
+func parseFloat(name, value string) float64 {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		logrus.WithError(err).WithField(name, value).Fatalln("couldn't parse number")
+	}
+	return f
+}
+
+func parseDuration(name, value string) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logrus.WithError(err).WithField(name, value).Fatalln("couldn't parse duration")
+	}
+	return d
+}
+
 func parseSerializationFormat(value string) (Serializer, error) {
-	switch value {
+	s, err := newSerializer(value)
+	if err == errUnknownFormat {
+		logrus.WithField("serialization-format-value", value).Warningln("invalid serialization format, using json")
+		return NewJSONSerializer()
+	}
+	return s, err
+}
+
+var errUnknownFormat = errors.New("unknown serialization format")
+
+// newSerializer creates the serializer of a format.
+func newSerializer(format string) (Serializer, error) {
+	switch format {
 	case "json":
 		return NewJSONSerializer()
 	case "avro-json":
 		return NewAvroJSONSerializer("schemas/metric.avsc")
 	default:
-		logrus.WithField("serialization-format-value", value).Warningln("invalid serialization format, using json")
+		return nil, errUnknownFormat
+	}
+}
+
+// newDeserializer creates the deserializer of a format.
+func newDeserializer(format string) (Deserializer, error) {
+	switch format {
+	case "json":
 		return NewJSONSerializer()
+	case "avro-json":
+		return NewAvroJSONSerializer("schemas/metric.avsc")
+	default:
+		return nil, errUnknownFormat
 	}
 }
 
@@ -0,0 +1,354 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// recordDecoder decodes the records produced by the adapter, in the format
+// told by their format header or, when they don't have it, in the fallback
+// one.
+type recordDecoder struct {
+	fallback Deserializer
+	formats  map[string]Deserializer
+}
+
+func newRecordDecoder(fallbackFormat string) (*recordDecoder, error) {
+	fallback, err := newDeserializer(fallbackFormat)
+	if err != nil {
+		return nil, fmt.Errorf("invalid format %q: %s", fallbackFormat, err)
+	}
+	return &recordDecoder{fallback: fallback, formats: map[string]Deserializer{fallbackFormat: fallback}}, nil
+}
+
+// serializationFormat returns the format of SERIALIZATION_FORMAT.
+func serializationFormat() string {
+	if d, ok := serializer.(describer); ok {
+		return d.Format()
+	}
+	return "json"
+}
+
+// decode returns the tenant of a record, taken from its tenant header or
+// defaulting to DEFAULT_TENANT, along with its sample.
+func (d *recordDecoder) decode(msg *kafka.Message) (string, *Sample, error) {
+	tenant, format := defaultTenant, ""
+	for _, h := range msg.Headers {
+		switch h.Key {
+		case headerTenant:
+			tenant = string(h.Value)
+		case headerFormat:
+			format = string(h.Value)
+		}
+	}
+
+	deserializer := d.fallback
+	if format != "" {
+		if deserializer = d.formats[format]; deserializer == nil {
+			var err error
+			if deserializer, err = newDeserializer(format); err != nil {
+				return "", nil, fmt.Errorf("unsupported record format %q: %s", format, err)
+			}
+			d.formats[format] = deserializer
+		}
+	}
+
+	sample, err := deserializer.Unmarshal(msg.Value)
+	return tenant, sample, err
+}
+
+// writeBatch groups the samples of a tenant per series.
+type writeBatch struct {
+	req    *prompb.WriteRequest
+	series map[uint64]int
+}
+
+func (b *writeBatch) add(ts *prompb.TimeSeries) {
+	key := hashLabels(ts.Labels)
+	if i, ok := b.series[key]; ok {
+		b.req.Timeseries[i].Samples = append(b.req.Timeseries[i].Samples, ts.Samples...)
+		return
+	}
+	b.series[key] = len(b.req.Timeseries)
+	b.req.Timeseries = append(b.req.Timeseries, *ts)
+}
+
+// consumeOptions configures the consume subcommand.
+type consumeOptions struct {
+	topics        []string
+	group         string
+	format        string
+	batchSize     int
+	flushInterval time.Duration
+	writer        forwarderConfig
+}
+
+func parseConsumeOptions(args []string) (*consumeOptions, error) {
+	opts := &consumeOptions{}
+	fs := flag.NewFlagSet("consume", flag.ContinueOnError)
+	topics := fs.String("topics", "", "comma separated list of the topics to consume")
+	fs.StringVar(&opts.group, "group", "prometheus-kafka-adapter-consume", "consumer group, whose committed offsets are resumed")
+	fs.StringVar(&opts.format, "format", "", "format of the records without format header, defaults to SERIALIZATION_FORMAT")
+	fs.IntVar(&opts.batchSize, "batch-size", 2000, "samples per write request")
+	fs.DurationVar(&opts.flushInterval, "flush-interval", 5*time.Second, "maximum time samples wait to be written")
+	fs.StringVar(&opts.writer.URL, "url", "", "remote write url the samples are written to")
+	fs.StringVar(&opts.writer.TenantHeader, "tenant-header", "", "header carrying the tenant of the records in the write requests")
+	fs.StringVar(&opts.writer.BearerTokenFile, "bearer-token-file", "", "file with the bearer token of the remote write endpoint")
+	fs.DurationVar(&opts.writer.Timeout, "timeout", 30*time.Second, "timeout of each write request")
+	fs.IntVar(&opts.writer.MaxRetries, "max-retries", 10, "retries of a failed write request before exiting, -1 disables them")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	for _, topic := range strings.Split(*topics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			opts.topics = append(opts.topics, topic)
+		}
+	}
+	if len(opts.topics) == 0 {
+		return nil, errors.New("no topics to consume")
+	}
+	if opts.writer.URL == "" {
+		return nil, errors.New("no remote write url")
+	}
+	if opts.batchSize <= 0 {
+		return nil, errors.New("the batch size must be positive")
+	}
+	if opts.flushInterval <= 0 {
+		return nil, errors.New("the flush interval must be positive")
+	}
+	return opts, nil
+}
+
+// runConsume replays the records of topics of the adapter to a remote write
+// endpoint, committing the offsets of the consumer group once the samples
+// read are written.
+func runConsume(args []string) error {
+	opts, err := parseConsumeOptions(args)
+	if err != nil {
+		return err
+	}
+
+	if opts.format == "" {
+		opts.format = serializationFormat()
+	}
+	decoder, err := newRecordDecoder(opts.format)
+	if err != nil {
+		return err
+	}
+	writer, err := newForwarder(opts.writer)
+	if err != nil {
+		return err
+	}
+
+	sink := envSinkConfig()
+	config, err := sink.consumerConfigMap(opts.group)
+	if err != nil {
+		return err
+	}
+	consumer, err := kafka.NewConsumer(&config)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+	refresher := newOAuthBearerRefresher(defaultSinkName, sink.OAuthBearer, consumer)
+	defer refresher.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	c := &replayConsumer{
+		consumer: consumer,
+		decoder:  decoder,
+		writer:   writer,
+		batches:  map[string]*writeBatch{},
+		offsets:  map[topicPartition]kafka.Offset{},
+	}
+	rebalance := func(_ *kafka.Consumer, ev kafka.Event) error {
+		if revoked, ok := ev.(kafka.RevokedPartitions); ok {
+			c.revoke(ctx, revoked.Partitions)
+		}
+		return nil
+	}
+	if err := consumer.SubscribeTopics(opts.topics, rebalance); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"topics": opts.topics, "group": opts.group, "url": opts.writer.URL}).Info("consuming")
+
+	lastFlush := time.Now()
+	for {
+		select {
+		case <-signals:
+			return c.flush(ctx)
+		default:
+		}
+
+		switch ev := consumer.Poll(100).(type) {
+		case *kafka.Message:
+			c.add(ev)
+		case kafka.OAuthBearerTokenRefresh:
+			refresher.refresh()
+		case kafka.Error:
+			if ev.IsFatal() {
+				return ev
+			}
+			logrus.WithError(ev).Warn("kafka consumer error")
+		}
+
+		if c.samples >= opts.batchSize || (c.samples > 0 && time.Since(lastFlush) >= opts.flushInterval) {
+			if err := c.flush(ctx); err != nil {
+				return err
+			}
+			lastFlush = time.Now()
+		}
+	}
+}
+
+// replayConsumer accumulates the samples read until they are written.
+type replayConsumer struct {
+	consumer *kafka.Consumer
+	decoder  *recordDecoder
+	writer   *forwarder
+	batches  map[string]*writeBatch
+	samples  int
+	// offsets holds the next offset of every partition read.
+	offsets map[topicPartition]kafka.Offset
+}
+
+// topicPartition identifies a partition.
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// kafkaMetadataTimeout is the timeout, in milliseconds, of the metadata
+// requests.
+const kafkaMetadataTimeout = 10000
+
+// partitionsSince lists the partitions of the topics, at the offset of their
+// first record since a time, or at their end when the time is zero. The
+// partitions without records since then are at their end as well.
+func partitionsSince(consumer *kafka.Consumer, topics []string, since time.Time) ([]kafka.TopicPartition, error) {
+	offset := kafka.OffsetEnd
+	if !since.IsZero() {
+		offset = kafka.Offset(since.UnixNano() / int64(time.Millisecond))
+	}
+
+	var partitions []kafka.TopicPartition
+	for _, topic := range topics {
+		topic := topic
+		metadata, err := consumer.GetMetadata(&topic, false, kafkaMetadataTimeout)
+		if err != nil {
+			return nil, err
+		}
+		t, ok := metadata.Topics[topic]
+		if !ok || t.Error.Code() != kafka.ErrNoError {
+			return nil, fmt.Errorf("couldn't get the partitions of topic %q: %s", topic, t.Error)
+		}
+		for _, p := range t.Partitions {
+			partitions = append(partitions, kafka.TopicPartition{Topic: &topic, Partition: p.ID, Offset: offset})
+		}
+	}
+	if len(partitions) == 0 || since.IsZero() {
+		return partitions, nil
+	}
+	return consumer.OffsetsForTimes(partitions, kafkaMetadataTimeout)
+}
+
+func (c *replayConsumer) add(msg *kafka.Message) {
+	tp := topicPartition{*msg.TopicPartition.Topic, msg.TopicPartition.Partition}
+	c.offsets[tp] = msg.TopicPartition.Offset + 1
+
+	tenant, sample, err := c.decoder.decode(msg)
+	if err != nil {
+		logrus.WithError(err).WithField("topic", tp.topic).Warn("skipping undecodable record")
+		return
+	}
+	ts := sample.TimeSeries()
+	b, ok := c.batches[tenant]
+	if !ok {
+		b = &writeBatch{req: &prompb.WriteRequest{}, series: map[uint64]int{}}
+		c.batches[tenant] = b
+	}
+	b.add(ts)
+	c.samples += len(ts.Samples)
+}
+
+// revoke flushes what was read before partitions are handed to another
+// consumer of the group, and forgets the offsets of those partitions when the
+// flush fails, so they aren't committed after losing them.
+func (c *replayConsumer) revoke(ctx context.Context, partitions []kafka.TopicPartition) {
+	if c.samples > 0 || len(c.offsets) > 0 {
+		if err := c.flush(ctx); err != nil {
+			logrus.WithError(err).Error("couldn't flush before the partitions are revoked")
+		}
+	}
+	for _, p := range partitions {
+		delete(c.offsets, topicPartition{*p.Topic, p.Partition})
+	}
+	logrus.WithField("partitions", len(partitions)).Info("partitions revoked")
+}
+
+// flush writes the batches of every tenant, with the samples of each series
+// sorted by time, and then commits the offsets read. Samples rejected by the
+// remote write endpoint are skipped, as retrying them would fail again.
+func (c *replayConsumer) flush(ctx context.Context) error {
+	for tenant, b := range c.batches {
+		for _, ts := range b.req.Timeseries {
+			sort.SliceStable(ts.Samples, func(i, j int) bool { return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp })
+		}
+		err := c.writer.write(ctx, b.req, tenant)
+		if _, ok := err.(*writeRejectedError); ok {
+			logrus.WithError(err).WithFields(logrus.Fields{"tenant": tenant, "samples": countSamples(b.req)}).Warn("skipping samples rejected by the remote write endpoint")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't write the samples of tenant %q: %s", tenant, err)
+		}
+	}
+
+	if len(c.offsets) > 0 {
+		offsets := make([]kafka.TopicPartition, 0, len(c.offsets))
+		for tp, offset := range c.offsets {
+			topic := tp.topic
+			offsets = append(offsets, kafka.TopicPartition{Topic: &topic, Partition: tp.partition, Offset: offset})
+		}
+		if _, err := c.consumer.CommitOffsets(offsets); err != nil {
+			return fmt.Errorf("couldn't commit offsets: %s", err)
+		}
+	}
+
+	logrus.WithField("samples", c.samples).Debug("samples written")
+	c.batches = map[string]*writeBatch{}
+	c.offsets = map[topicPartition]kafka.Offset{}
+	c.samples = 0
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConsumeOptions(t *testing.T) {
+	opts, err := parseConsumeOptions([]string{"-topics", "metrics, metrics.team-a", "-url", "http://mimir/api/v1/push", "-batch-size", "10"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"metrics", "metrics.team-a"}, opts.topics)
+	assert.Equal(t, "prometheus-kafka-adapter-consume", opts.group)
+	assert.Equal(t, 10, opts.batchSize)
+
+	for _, invalid := range [][]string{
+		{"-url", "http://mimir/api/v1/push"},
+		{"-topics", "metrics"},
+		{"-topics", "metrics", "-url", "http://mimir/api/v1/push", "-batch-size", "0"},
+		{"-unknown"},
+	} {
+		_, err := parseConsumeOptions(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestReplayConsumer(t *testing.T) {
+	var received []*prompb.WriteRequest
+	var tenants []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		assert.Nil(t, err)
+		var req prompb.WriteRequest
+		assert.Nil(t, proto.Unmarshal(data, &req))
+		received = append(received, &req)
+		tenants = append(tenants, r.Header.Get("X-Scope-OrgID"))
+	}))
+	defer server.Close()
+
+	writer, err := newForwarder(forwarderConfig{URL: server.URL, TenantHeader: "X-Scope-OrgID"})
+	assert.Nil(t, err)
+	decoder, err := newRecordDecoder("json")
+	assert.Nil(t, err)
+	c := &replayConsumer{
+		decoder: decoder,
+		writer:  writer,
+		batches: map[string]*writeBatch{},
+		offsets: map[topicPartition]kafka.Offset{},
+	}
+
+	topic := "metrics"
+	record := func(offset int64, value string, headers ...kafka.Header) *kafka.Message {
+		return &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 1, Offset: kafka.Offset(offset)},
+			Value:          []byte(value),
+			Headers:        headers,
+		}
+	}
+	c.add(record(10, `{"timestamp":"2022-10-01T10:00:10Z","value":"2","name":"up","labels":{"__name__":"up","job":"api"}}`))
+	c.add(record(11, `{"timestamp":"2022-10-01T10:00:00Z","value":"+Inf","name":"up","labels":{"__name__":"up","job":"api"}}`))
+	c.add(record(12, `not json`))
+	c.add(record(13, `{"timestamp":"2022-10-01T10:00:00Z","value":"1","name":"up","labels":{"__name__":"up"}}`, kafka.Header{Key: headerTenant, Value: []byte("team-a")}))
+	c.add(record(14, `{}`, kafka.Header{Key: headerFormat, Value: []byte("protobuf")}))
+
+	assert.Equal(t, 3, c.samples)
+	assert.Equal(t, kafka.Offset(15), c.offsets[topicPartition{"metrics", 1}])
+
+	// Flushing without offsets doesn't need the consumer.
+	c.offsets = map[topicPartition]kafka.Offset{}
+	assert.Nil(t, c.flush(context.Background()))
+	assert.Len(t, received, 2)
+	assert.ElementsMatch(t, []string{"", "team-a"}, tenants)
+	for i, req := range received {
+		if tenants[i] != "" {
+			continue
+		}
+		assert.Len(t, req.Timeseries, 1)
+		assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}}, req.Timeseries[0].Labels)
+		assert.Equal(t, int64(1664618400000), req.Timeseries[0].Samples[0].Timestamp)
+		assert.Equal(t, int64(1664618410000), req.Timeseries[0].Samples[1].Timestamp)
+	}
+	assert.Zero(t, c.samples)
+	assert.Empty(t, c.batches)
+}
+
+func TestReplayConsumerRejectedSamples(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	writer, err := newForwarder(forwarderConfig{URL: server.URL, MaxRetries: 3})
+	assert.Nil(t, err)
+	decoder, err := newRecordDecoder("json")
+	assert.Nil(t, err)
+	c := &replayConsumer{
+		decoder: decoder,
+		writer:  writer,
+		batches: map[string]*writeBatch{},
+		offsets: map[topicPartition]kafka.Offset{},
+	}
+
+	topic := "metrics"
+	c.add(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 1, Offset: 10},
+		Value:          []byte(`{"timestamp":"2022-10-01T10:00:00Z","value":"1","name":"up","labels":{"__name__":"up"}}`),
+	})
+	c.offsets = map[topicPartition]kafka.Offset{}
+
+	// Rejected samples are skipped without being retried.
+	assert.Nil(t, c.flush(context.Background()))
+	assert.Equal(t, 1, requests)
+	assert.Zero(t, c.samples)
+	assert.Empty(t, c.batches)
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// failoverConfig defines the standby sink production switches to when a sink
+// is unavailable.
+type failoverConfig struct {
+	Standby       string        `yaml:"standby"`
+	After         time.Duration `yaml:"after"`
+	RecoverAfter  time.Duration `yaml:"recover_after"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+// failover switches the production of a sink to its standby when the brokers
+// of the primary have been unreachable for a while, and back when they have
+// been reachable for a while, so it doesn't flap.
+type failover struct {
+	failoverConfig
+	primary *reloadableProducer
+	standby *reloadableProducer
+
+	mu        sync.Mutex
+	active    bool
+	downSince time.Time
+	upSince   time.Time
+}
+
+// failovers holds the failover of the sinks having a standby, it is only
+// written on startup.
+var failovers = map[string]*failover{}
+
+func validateFailovers(configs map[string]*failoverConfig, sinks map[string]*sinkConfig) error {
+	known := func(name string) bool {
+		_, ok := sinks[name]
+		return ok || name == defaultSinkName
+	}
+
+	for name, f := range configs {
+		if f == nil || f.Standby == "" {
+			return fmt.Errorf("failover of sink %q has no standby", name)
+		}
+		if !known(name) {
+			return fmt.Errorf("failover defined for unknown sink %q", name)
+		}
+		if !known(f.Standby) || f.Standby == name {
+			return fmt.Errorf("invalid standby %q for sink %q", f.Standby, name)
+		}
+		if _, ok := configs[f.Standby]; ok {
+			return fmt.Errorf("standby %q of sink %q can't have a standby itself", f.Standby, name)
+		}
+		if f.After <= 0 {
+			f.After = time.Minute
+		}
+		if f.RecoverAfter <= 0 {
+			f.RecoverAfter = 5 * time.Minute
+		}
+		if f.CheckInterval <= 0 {
+			f.CheckInterval = 10 * time.Second
+		}
+	}
+	return nil
+}
+
+func newFailover(config failoverConfig, primary, standby *reloadableProducer) *failover {
+	f := &failover{failoverConfig: config, primary: primary, standby: standby}
+	failoverActive.WithLabelValues(primary.name).Set(0)
+	primary.setFallback(f.retry)
+	return f
+}
+
+// target returns the producer currently in use.
+func (f *failover) target() *reloadableProducer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active {
+		return f.standby
+	}
+	return f.primary
+}
+
+// run checks the primary brokers every check interval.
+func (f *failover) run() {
+	for range time.Tick(f.CheckInterval) {
+		f.check(f.primary.probe(f.CheckInterval/2) == nil, time.Now())
+	}
+}
+
+// check records the state of the primary brokers, switching the target when
+// they have been down or up long enough.
+func (f *failover) check(up bool, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if up {
+		f.downSince = time.Time{}
+		if f.upSince.IsZero() {
+			f.upSince = now
+		}
+	} else {
+		f.upSince = time.Time{}
+		if f.downSince.IsZero() {
+			f.downSince = now
+		}
+	}
+
+	switch {
+	case !f.active && !up && now.Sub(f.downSince) >= f.After:
+		f.active = true
+		failoverActive.WithLabelValues(f.primary.name).Set(1)
+		failoverSwitches.WithLabelValues(f.primary.name).Inc()
+		logrus.WithFields(logrus.Fields{"sink": f.primary.name, "standby": f.standby.name}).Warn("kafka sink unavailable, switching to its standby")
+	case f.active && up && now.Sub(f.upSince) >= f.RecoverAfter:
+		f.active = false
+		failoverActive.WithLabelValues(f.primary.name).Set(0)
+		failoverSwitches.WithLabelValues(f.primary.name).Inc()
+		logrus.WithFields(logrus.Fields{"sink": f.primary.name, "standby": f.standby.name}).Info("kafka sink recovered, switching back from its standby")
+	}
+}
+
+// retry produces a message the primary couldn't deliver in the standby, when
+// the primary is unavailable. It tells whether the message was handed over.
+func (f *failover) retry(msg *kafka.Message) bool {
+	f.mu.Lock()
+	unavailable := f.active || !f.downSince.IsZero()
+	f.mu.Unlock()
+	if !unavailable && f.primary.healthy() {
+		return false
+	}
+
+	msg.TopicPartition.Partition = kafka.PartitionAny
+	msg.TopicPartition.Error = nil
+	if err := f.standby.Produce(msg); err != nil {
+		return false
+	}
+	failoverRetried.WithLabelValues(f.primary.name).Inc()
+	sinkProduced.WithLabelValues(f.standby.name).Inc()
+	return true
+}
+
+// sinkTarget returns the producer to be used for a sink, which is its
+// standby while it has failed over.
+func sinkTarget(name string) *reloadableProducer {
+	if f, ok := failovers[name]; ok {
+		return f.target()
+	}
+	return sinkProducers[name]
+}
+
+// sinksReadiness reports the health and the current target of every sink,
+// and whether all of them can be produced to.
+func sinksReadiness() (map[string]map[string]string, bool) {
+	ready := true
+	status := make(map[string]map[string]string, len(sinkProducers))
+	for name, p := range sinkProducers {
+		target := sinkTarget(name)
+		health := "UP"
+		if !p.healthy() {
+			health = "DOWN"
+		}
+		if !target.healthy() {
+			ready = false
+		}
+		status[name] = map[string]string{"status": health, "target": target.name}
+	}
+	return status, ready
+}
+
+// readyHandler answers 503 while any sink can't be produced to, neither
+// directly nor through its standby.
+func readyHandler(c *gin.Context) {
+	sinks, ready := sinksReadiness()
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "NOT_READY", "sinks": sinks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "READY", "sinks": sinks})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailoverHysteresis(t *testing.T) {
+	primary := &reloadableProducer{name: "primary"}
+	standby := &reloadableProducer{name: "standby"}
+	f := &failover{
+		failoverConfig: failoverConfig{Standby: "standby", After: time.Minute, RecoverAfter: 5 * time.Minute},
+		primary:        primary,
+		standby:        standby,
+	}
+	now := time.Unix(0, 0)
+
+	f.check(false, now)
+	f.check(false, now.Add(30*time.Second))
+	assert.Equal(t, primary, f.target(), "short outages don't switch")
+
+	f.check(true, now.Add(40*time.Second))
+	f.check(false, now.Add(50*time.Second))
+	f.check(false, now.Add(100*time.Second))
+	assert.Equal(t, primary, f.target(), "the outage restarts when the primary comes back")
+
+	f.check(false, now.Add(110*time.Second))
+	assert.Equal(t, standby, f.target())
+
+	f.check(true, now.Add(2*time.Minute))
+	f.check(false, now.Add(3*time.Minute))
+	f.check(true, now.Add(4*time.Minute))
+	f.check(true, now.Add(8*time.Minute))
+	assert.Equal(t, standby, f.target(), "the primary must stay up before switching back")
+
+	f.check(true, now.Add(9*time.Minute))
+	assert.Equal(t, primary, f.target())
+}
+
+func TestFailoverValidation(t *testing.T) {
+	_, err := parseSinks([]byte(`
+sinks:
+  dr:
+    brokers: kafka-dr:9092
+failover:
+  default:
+    standby: dr
+`))
+	assert.Nil(t, err)
+
+	_, err = parseSinks([]byte(`
+sinks:
+  dr:
+    brokers: kafka-dr:9092
+failover:
+  default:
+    standby: dr
+  dr:
+    standby: default
+`))
+	assert.NotNil(t, err, "standbys can't fail over")
+}
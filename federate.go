@@ -0,0 +1,248 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Results of the scrapes, as counted by federate_scrapes_total.
+const (
+	scrapeSucceeded = "success"
+	scrapeFailed    = "failed"
+	scrapeRejected  = "rejected"
+)
+
+// scrapeAccept is the Accept header of the scrapes, the one sent by
+// Prometheus.
+const scrapeAccept = "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+
+// scrapeTargetConfig defines an endpoint in exposition format, like the
+// /federate endpoint of a Prometheus server, that is scraped periodically.
+type scrapeTargetConfig struct {
+	URL             string            `yaml:"url"`
+	Interval        time.Duration     `yaml:"interval"`
+	Timeout         time.Duration     `yaml:"timeout"`
+	Tenant          string            `yaml:"tenant"`
+	Labels          map[string]string `yaml:"labels"`
+	Headers         map[string]string `yaml:"headers"`
+	BearerTokenFile string            `yaml:"bearer_token_file"`
+	BasicAuth       *struct {
+		Username     string `yaml:"username"`
+		PasswordFile string `yaml:"password_file"`
+	} `yaml:"basic_auth"`
+}
+
+// scrapeTarget feeds the samples scraped from an endpoint into the ingestion
+// pipeline, as if they had been received in a write request.
+type scrapeTarget struct {
+	scrapeTargetConfig
+	client      *http.Client
+	bearerToken *secret
+	password    *secret
+}
+
+// scrapeTargets holds the configured targets, it is only written on startup.
+var scrapeTargets []*scrapeTarget
+
+func loadScrapeTargets(path string) ([]*scrapeTarget, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseScrapeTargets(content)
+}
+
+func parseScrapeTargets(content []byte) ([]*scrapeTarget, error) {
+	var configs []*scrapeTargetConfig
+	if err := yaml.UnmarshalStrict(content, &configs); err != nil {
+		return nil, err
+	}
+
+	result := make([]*scrapeTarget, 0, len(configs))
+	for i, c := range configs {
+		if c == nil || c.URL == "" {
+			return nil, fmt.Errorf("scrape target %d has no url", i)
+		}
+		t, err := newScrapeTarget(*c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scrape target %s: %s", c.URL, err)
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+func newScrapeTarget(c scrapeTargetConfig) (*scrapeTarget, error) {
+	if c.Interval <= 0 {
+		c.Interval = time.Minute
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.Timeout > c.Interval {
+		return nil, fmt.Errorf("timeout %s is greater than the interval %s", c.Timeout, c.Interval)
+	}
+	if c.Tenant == "" {
+		c.Tenant = defaultTenant
+	} else if err := validateTenant(c.Tenant); err != nil {
+		return nil, err
+	}
+	for name := range c.Labels {
+		if !model.LabelName(name).IsValid() || name == model.MetricNameLabel {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+	}
+
+	t := &scrapeTarget{
+		scrapeTargetConfig: c,
+		client:             &http.Client{Timeout: c.Timeout},
+		bearerToken:        &secret{name: "bearer_token of scrape target " + c.URL, file: c.BearerTokenFile},
+		password:           &secret{name: "basic_auth password of scrape target " + c.URL},
+	}
+	if c.BasicAuth != nil {
+		t.password.file = c.BasicAuth.PasswordFile
+	}
+	if err := reloadSecrets(t.bearerToken, t.password); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// files returns the secret files of the target.
+func (t *scrapeTarget) files() []string {
+	return secretFiles(t.bearerToken, t.password)
+}
+
+// reload reads again the secret files of the target.
+func (t *scrapeTarget) reload() error {
+	return reloadSecrets(t.bearerToken, t.password)
+}
+
+// run scrapes the target every interval until the context is done.
+func (t *scrapeTarget) run(ctx context.Context, serializer Serializer) {
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+
+	for {
+		t.scrapeAndIngest(ctx, serializer)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scrapeAndIngest scrapes the target once, ingesting its samples and
+// updating its health metrics.
+func (t *scrapeTarget) scrapeAndIngest(ctx context.Context, serializer Serializer) {
+	start := time.Now()
+	req, size, err := t.scrape(ctx, start)
+	federateScrapeDuration.WithLabelValues(t.URL).Set(time.Since(start).Seconds())
+	if err != nil {
+		federateUp.WithLabelValues(t.URL).Set(0)
+		federateScrapes.WithLabelValues(t.URL, scrapeFailed).Inc()
+		logrus.WithError(err).WithField("url", t.URL).Warn("couldn't scrape target")
+		return
+	}
+	federateUp.WithLabelValues(t.URL).Set(1)
+	federateScrapeSamples.WithLabelValues(t.URL).Set(float64(countSamples(req)))
+
+	meta := requestMeta{requestID: newRequestID(), remoteAddr: t.URL, tenant: t.Tenant}
+	if _, err := ingest(serializer, req, meta, nil, size); err != nil {
+		federateScrapes.WithLabelValues(t.URL, scrapeRejected).Inc()
+		logrus.WithError(err).WithField("url", t.URL).Error("couldn't ingest scraped samples")
+		return
+	}
+	federateScrapes.WithLabelValues(t.URL, scrapeSucceeded).Inc()
+}
+
+// scrape fetches the samples of the target, along with the size of the
+// response. Samples without timestamp take the time of the scrape, and the
+// static labels of the target are added to the series missing them.
+func (t *scrapeTarget) scrape(ctx context.Context, now time.Time) (*prompb.WriteRequest, int, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, t.URL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	httpReq.Header.Set("Accept", scrapeAccept)
+	httpReq.Header.Set("User-Agent", "prometheus-kafka-adapter")
+	httpReq.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(t.Timeout.Seconds(), 'f', -1, 64))
+	for k, v := range t.Headers {
+		httpReq.Header.Set(k, v)
+	}
+	if token := t.bearerToken.Value(); token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	if t.BasicAuth != nil {
+		httpReq.SetBasicAuth(t.BasicAuth.Username, t.password.Value())
+	}
+
+	resp, err := t.client.Do(httpReq)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, 0, fmt.Errorf("server returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := pushToWriteRequest(body, resp.Header, nil, now)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(t.Labels) > 0 {
+		for i, ts := range req.Timeseries {
+			req.Timeseries[i].Labels = addMissingLabels(ts.Labels, t.Labels)
+		}
+	}
+	return req, len(body), nil
+}
+
+// addMissingLabels adds the labels a series doesn't have, keeping them
+// sorted.
+func addMissingLabels(labels []prompb.Label, extra map[string]string) []prompb.Label {
+	present := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		present[l.Name] = true
+	}
+	for name, value := range extra {
+		if !present[name] {
+			labels = append(labels, prompb.Label{Name: name, Value: value})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
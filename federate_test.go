@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScrapeTargets(t *testing.T) {
+	targets, err := parseScrapeTargets([]byte(`
+- url: http://prometheus:9090/federate?match[]={job="api"}
+  interval: 30s
+  labels: {source: federate}
+- url: http://node:9100/metrics
+`))
+	assert.Nil(t, err)
+	assert.Len(t, targets, 2)
+	assert.Equal(t, 30*time.Second, targets[0].Interval)
+	assert.Equal(t, 10*time.Second, targets[0].Timeout)
+	assert.Equal(t, time.Minute, targets[1].Interval)
+
+	for _, invalid := range []string{
+		"- interval: 1m",
+		"- {url: http://a, interval: 5s, timeout: 10s}",
+		"- {url: http://a, labels: {__name__: x}}",
+		"- {url: http://a, labels: {0x: y}}",
+		"- {url: http://a, scheme: https}",
+	} {
+		_, err := parseScrapeTargets([]byte(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestScrapeTarget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "adapter" || password != "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte("# TYPE up untyped\nup{job=\"api\",instance=\"a:80\"} 1 1600000000000\nup{job=\"web\",source=\"scraped\"} 0\n"))
+	}))
+	defer server.Close()
+
+	targets, err := parseScrapeTargets([]byte("- {url: '" + server.URL + "/federate', labels: {source: federate}, basic_auth: {username: adapter}}"))
+	assert.Nil(t, err)
+	target := targets[0]
+
+	now := time.Unix(1700000000, 0)
+	req, size, err := target.scrape(context.Background(), now)
+	assert.Nil(t, err)
+	assert.NotZero(t, size)
+	assert.ElementsMatch(t, []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "a:80"}, {Name: "job", Value: "api"}, {Name: "source", Value: "federate"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1600000000000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "web"}, {Name: "source", Value: "scraped"}},
+			Samples: []prompb.Sample{{Value: 0, Timestamp: 1700000000000}},
+		},
+	}, req.Timeseries)
+
+	target.BasicAuth.Username = "someone"
+	target.scrapeAndIngest(context.Background(), nil)
+	assert.Equal(t, float64(0), testutil.ToFloat64(federateUp.WithLabelValues(target.URL)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(federateScrapes.WithLabelValues(target.URL, scrapeFailed)))
+}
@@ -0,0 +1,338 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Results of the forwarded requests, as counted by
+// remote_write_forward_requests_total.
+const (
+	forwardSucceeded = "success"
+	forwardFailed    = "failed"
+	forwardDropped   = "dropped"
+)
+
+// forwarderConfig defines a remote-write endpoint the received samples are
+// forwarded to.
+type forwarderConfig struct {
+	URL             string            `yaml:"url"`
+	Headers         map[string]string `yaml:"headers"`
+	TenantHeader    string            `yaml:"tenant_header"`
+	BearerTokenFile string            `yaml:"bearer_token_file"`
+	BasicAuth       *struct {
+		Username     string `yaml:"username"`
+		PasswordFile string `yaml:"password_file"`
+	} `yaml:"basic_auth"`
+	Timeout             time.Duration     `yaml:"timeout"`
+	QueueCapacity       int               `yaml:"queue_capacity"`
+	MaxRetries          int               `yaml:"max_retries"`
+	MinBackoff          time.Duration     `yaml:"min_backoff"`
+	MaxBackoff          time.Duration     `yaml:"max_backoff"`
+	WriteRelabelConfigs []*relabel.Config `yaml:"write_relabel_configs"`
+}
+
+// forwarder re-sends write requests to a remote-write endpoint from its own
+// queue, so a slow endpoint doesn't hold up the ingestion. Requests are
+// dropped when the queue is full.
+type forwarder struct {
+	forwarderConfig
+	client      *http.Client
+	queue       chan forwardRequest
+	bearerToken *secret
+	password    *secret
+}
+
+type forwardRequest struct {
+	req    *prompb.WriteRequest
+	tenant string
+}
+
+// forwarders holds the configured forwarders, it is only written on startup.
+var forwarders []*forwarder
+
+func loadForwarders(path string) ([]*forwarder, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseForwarders(content)
+}
+
+func parseForwarders(content []byte) ([]*forwarder, error) {
+	var configs []*forwarderConfig
+	if err := yaml.UnmarshalStrict(content, &configs); err != nil {
+		return nil, err
+	}
+
+	result := make([]*forwarder, 0, len(configs))
+	for i, c := range configs {
+		if c == nil || c.URL == "" {
+			return nil, fmt.Errorf("forwarder %d has no url", i)
+		}
+		f, err := newForwarder(*c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forwarder %s: %s", c.URL, err)
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+func newForwarder(c forwarderConfig) (*forwarder, error) {
+	if c.Timeout <= 0 {
+		c.Timeout = 30 * time.Second
+	}
+	if c.QueueCapacity <= 0 {
+		c.QueueCapacity = 1000
+	}
+	if c.MaxRetries < 0 {
+		c.MaxRetries = 0
+	} else if c.MaxRetries == 0 {
+		c.MaxRetries = 5
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = 100 * time.Millisecond
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = 10 * time.Second
+	}
+
+	f := &forwarder{
+		forwarderConfig: c,
+		client:          &http.Client{Timeout: c.Timeout},
+		queue:           make(chan forwardRequest, c.QueueCapacity),
+		bearerToken:     &secret{name: "bearer_token of forwarder " + c.URL, file: c.BearerTokenFile},
+		password:        &secret{name: "basic_auth password of forwarder " + c.URL},
+	}
+	if c.BasicAuth != nil {
+		f.password.file = c.BasicAuth.PasswordFile
+	}
+	if err := reloadSecrets(f.bearerToken, f.password); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// files returns the secret files of the forwarder.
+func (f *forwarder) files() []string {
+	return secretFiles(f.bearerToken, f.password)
+}
+
+// reload reads again the secret files of the forwarder.
+func (f *forwarder) reload() error {
+	return reloadSecrets(f.bearerToken, f.password)
+}
+
+// enqueue relabels a copy of a write request and queues it, dropping it when
+// the queue is full.
+func (f *forwarder) enqueue(req *prompb.WriteRequest, tenant string) {
+	relabeled := f.relabel(req)
+	if len(relabeled.Timeseries) == 0 {
+		return
+	}
+
+	select {
+	case f.queue <- forwardRequest{req: relabeled, tenant: tenant}:
+		forwardQueueLength.WithLabelValues(f.URL).Set(float64(len(f.queue)))
+	default:
+		forwardRequests.WithLabelValues(f.URL, forwardDropped).Inc()
+		logrus.WithField("url", f.URL).Warn("remote write forward queue is full, dropping request")
+	}
+}
+
+func (f *forwarder) relabel(req *prompb.WriteRequest) *prompb.WriteRequest {
+	result := &prompb.WriteRequest{Timeseries: make([]prompb.TimeSeries, 0, len(req.Timeseries))}
+	for _, ts := range req.Timeseries {
+		if len(f.WriteRelabelConfigs) == 0 {
+			result.Timeseries = append(result.Timeseries, ts)
+			continue
+		}
+
+		lset := make(labels.Labels, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			lset = append(lset, labels.Label{Name: l.Name, Value: l.Value})
+		}
+		lset = relabel.Process(labels.New(lset...), f.WriteRelabelConfigs...)
+		if lset == nil {
+			continue
+		}
+
+		relabeled := prompb.TimeSeries{Labels: make([]prompb.Label, 0, len(lset)), Samples: ts.Samples}
+		for _, l := range lset {
+			relabeled.Labels = append(relabeled.Labels, prompb.Label{Name: l.Name, Value: l.Value})
+		}
+		result.Timeseries = append(result.Timeseries, relabeled)
+	}
+	return result
+}
+
+// run sends the queued requests until the context is done.
+func (f *forwarder) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-f.queue:
+			forwardQueueLength.WithLabelValues(f.URL).Set(float64(len(f.queue)))
+			f.send(ctx, r)
+		}
+	}
+}
+
+// send posts a request, counting its result.
+func (f *forwarder) send(ctx context.Context, r forwardRequest) {
+	if err := f.write(ctx, r.req, r.tenant); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		forwardRequests.WithLabelValues(f.URL, forwardFailed).Inc()
+		logrus.WithError(err).WithField("url", f.URL).Error("couldn't forward write request")
+		return
+	}
+	forwardRequests.WithLabelValues(f.URL, forwardSucceeded).Inc()
+	forwardSamples.WithLabelValues(f.URL).Add(float64(countSamples(r.req)))
+}
+
+// write posts a write request, retrying with exponential backoff on network
+// errors, 5xx and 429 responses.
+func (f *forwarder) write(ctx context.Context, req *prompb.WriteRequest, tenant string) error {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal write request: %s", err)
+	}
+	body := snappy.Encode(nil, data)
+
+	backoff := f.MinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := f.post(ctx, body, tenant)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= f.MaxRetries {
+			return err
+		}
+
+		forwardRetries.WithLabelValues(f.URL).Inc()
+		logrus.WithError(err).WithFields(logrus.Fields{"url": f.URL, "backoff": backoff}).Debug("retrying write request")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > f.MaxBackoff {
+			backoff = f.MaxBackoff
+		}
+	}
+}
+
+// post sends a request once, telling whether it may be retried when it fails.
+func (f *forwarder) post(ctx context.Context, body []byte, tenant string) (bool, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, f.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", "prometheus-kafka-adapter")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range f.Headers {
+		httpReq.Header.Set(k, v)
+	}
+	if f.TenantHeader != "" && tenant != "" {
+		httpReq.Header.Set(f.TenantHeader, tenant)
+	}
+	if token := f.bearerToken.Value(); token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	if f.BasicAuth != nil {
+		httpReq.SetBasicAuth(f.BasicAuth.Username, f.password.Value())
+	}
+
+	resp, err := f.client.Do(httpReq)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return true, fmt.Errorf("server returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return false, &writeRejectedError{status: resp.Status, message: strings.TrimSpace(string(msg))}
+}
+
+// writeRejectedError is returned when the remote write endpoint rejects a
+// request with a response that must not be retried, like a 4xx.
+type writeRejectedError struct {
+	status  string
+	message string
+}
+
+func (e *writeRejectedError) Error() string {
+	return fmt.Sprintf("server returned HTTP status %s: %s", e.status, e.message)
+}
+
+func countSamples(req *prompb.WriteRequest) int {
+	n := 0
+	for _, ts := range req.Timeseries {
+		n += len(ts.Samples)
+	}
+	return n
+}
+
+// forwardWriteRequest queues the series of a request passing the match rules
+// of the tenant in every forwarder.
+func forwardWriteRequest(req *prompb.WriteRequest, tenant string) {
+	if len(forwarders) == 0 {
+		return
+	}
+
+	matchRules := tenantMatch(overridesFor(tenant))
+	filtered := &prompb.WriteRequest{Timeseries: make([]prompb.TimeSeries, 0, len(req.Timeseries))}
+	for _, ts := range req.Timeseries {
+		labels := make(map[string]string, len(ts.Labels))
+		for _, l := range ts.Labels {
+			labels[l.Name] = l.Value
+		}
+		if filterMatch(matchRules, labels["__name__"], labels) {
+			filtered.Timeseries = append(filtered.Timeseries, ts)
+		}
+	}
+
+	for _, f := range forwarders {
+		f.enqueue(filtered, tenant)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwarder(t *testing.T) {
+	var attempts int32
+	received := make(chan *prompb.WriteRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "Bearer secret-token", r.Header.Get("Authorization"))
+		assert.Equal(t, "team-a", r.Header.Get("X-Scope-OrgID"))
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+
+		compressed, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		assert.Nil(t, err)
+		var req prompb.WriteRequest
+		assert.Nil(t, proto.Unmarshal(data, &req))
+		received <- &req
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("secret-token\n"), 0600))
+
+	forwarders, err := parseForwarders([]byte(`
+- url: ` + server.URL + `
+  tenant_header: X-Scope-OrgID
+  bearer_token_file: ` + tokenFile + `
+  min_backoff: 1ms
+  write_relabel_configs:
+    - source_labels: [__name__]
+      regex: foo
+      action: keep
+    - regex: label.*
+      action: labeldrop
+`))
+	assert.Nil(t, err)
+	f := forwarders[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.run(ctx)
+
+	req := NewWriteRequest()
+	req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "bar"}},
+		Samples: []prompb.Sample{{Timestamp: 0, Value: 1}},
+	})
+	f.enqueue(req, "team-a")
+
+	select {
+	case got := <-received:
+		assert.Len(t, got.Timeseries, 1, "series are relabeled before being forwarded")
+		assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "foo"}}, got.Timeseries[0].Labels)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&attempts), "5xx responses are retried")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request wasn't forwarded")
+	}
+}
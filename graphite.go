@@ -0,0 +1,532 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pickle "github.com/kisielk/og-rek"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Protocols and parse error reasons, as exported by the graphite metrics.
+const (
+	graphiteTCP    = "tcp"
+	graphiteUDP    = "udp"
+	graphitePickle = "pickle"
+
+	reasonInvalidLine      = "invalid_line"
+	reasonInvalidValue     = "invalid_value"
+	reasonInvalidTimestamp = "invalid_timestamp"
+	reasonLineTooLong      = "line_too_long"
+	reasonInvalidPickle    = "invalid_pickle"
+)
+
+const (
+	// graphiteBatchSize is the number of samples a connection ingests at
+	// once at most.
+	graphiteBatchSize = 1000
+
+	// graphitePickleMaxSize is the largest pickle message accepted, larger
+	// ones close the connection.
+	graphitePickleMaxSize = 16 << 20
+)
+
+// graphiteMapping converts the graphite paths matching it into a metric
+// name and labels. Glob patterns match with * any part of a path component,
+// regex ones the whole path. The captures are referenced as $1, $2...
+type graphiteMapping struct {
+	Match     string            `yaml:"match"`
+	MatchType string            `yaml:"match_type"`
+	Name      string            `yaml:"name"`
+	Labels    map[string]string `yaml:"labels"`
+	Action    string            `yaml:"action"`
+
+	regex *regexp.Regexp
+}
+
+var (
+	graphiteMappingsMu sync.RWMutex
+	graphiteMappings   []*graphiteMapping
+)
+
+func loadGraphiteMappings(path string) ([]*graphiteMapping, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseGraphiteMappings(content)
+}
+
+func parseGraphiteMappings(content []byte) ([]*graphiteMapping, error) {
+	var file struct {
+		Mappings []*graphiteMapping `yaml:"mappings"`
+	}
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, err
+	}
+
+	for i, m := range file.Mappings {
+		if m == nil || m.Match == "" {
+			return nil, fmt.Errorf("mapping %d has no match", i)
+		}
+		pattern := m.Match
+		switch m.MatchType {
+		case "", "glob":
+			pattern = globToRegexp(m.Match)
+		case "regex":
+		default:
+			return nil, fmt.Errorf("invalid match_type %q of mapping %q", m.MatchType, m.Match)
+		}
+		var err error
+		if m.regex, err = regexp.Compile("^(?:" + pattern + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid match of mapping %q: %s", m.Match, err)
+		}
+
+		switch m.Action {
+		case "drop":
+			continue
+		case "", "map":
+		default:
+			return nil, fmt.Errorf("invalid action %q of mapping %q", m.Action, m.Match)
+		}
+		if m.Name == "" {
+			return nil, fmt.Errorf("mapping %q has no name", m.Match)
+		}
+		for name := range m.Labels {
+			if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+				return nil, fmt.Errorf("invalid label name %q in mapping %q", name, m.Match)
+			}
+		}
+	}
+	return file.Mappings, nil
+}
+
+// globToRegexp turns a glob matching graphite paths into a regular
+// expression capturing what every * matches.
+func globToRegexp(glob string) string {
+	parts := strings.Split(glob, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return strings.Join(parts, "([^.]*)")
+}
+
+func setGraphiteMappings(mappings []*graphiteMapping) {
+	graphiteMappingsMu.Lock()
+	defer graphiteMappingsMu.Unlock()
+	graphiteMappings = mappings
+}
+
+// mapGraphitePath returns the labels of the series of a graphite path,
+// tagged or not, and whether it must be kept. Paths matching no mapping
+// take their sanitized path as name.
+func mapGraphitePath(path string) ([]prompb.Label, bool) {
+	parts := strings.Split(path, ";")
+	path = parts[0]
+	labels := map[string]string{}
+	for _, tag := range parts[1:] {
+		if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 && kv[0] != "" && kv[0] != "name" {
+			labels[sanitizeLabelName(kv[0])] = kv[1]
+		}
+	}
+	labels["__name__"] = sanitizeMetricName(path)
+
+	graphiteMappingsMu.RLock()
+	defer graphiteMappingsMu.RUnlock()
+
+	for _, m := range graphiteMappings {
+		match := m.regex.FindStringSubmatchIndex(path)
+		if match == nil {
+			continue
+		}
+		if m.Action == "drop" {
+			return nil, false
+		}
+		if name := string(m.regex.ExpandString(nil, m.Name, path, match)); name != "" {
+			labels["__name__"] = sanitizeMetricName(name)
+		}
+		for k, v := range m.Labels {
+			labels[k] = string(m.regex.ExpandString(nil, v, path, match))
+		}
+		break
+	}
+
+	result := make([]prompb.Label, 0, len(labels))
+	for k, v := range labels {
+		result = append(result, prompb.Label{Name: k, Value: v})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, true
+}
+
+// graphiteBatch accumulates the samples read from a connection or packet.
+type graphiteBatch struct {
+	protocol string
+	now      func() time.Time
+	req      *prompb.WriteRequest
+	series   map[uint64]int
+	samples  int
+	size     int
+}
+
+func newGraphiteBatch(protocol string) *graphiteBatch {
+	return &graphiteBatch{protocol: protocol, now: time.Now, req: &prompb.WriteRequest{}, series: map[uint64]int{}}
+}
+
+// addLine parses a plaintext line, path value timestamp. A timestamp of -1
+// stands for the current time.
+func (b *graphiteBatch) addLine(line string) {
+	b.size += len(line)
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		graphiteParseErrors.WithLabelValues(b.protocol, reasonInvalidLine).Inc()
+		logrus.WithField("line", line).Debug("invalid graphite line")
+		return
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		graphiteParseErrors.WithLabelValues(b.protocol, reasonInvalidValue).Inc()
+		logrus.WithField("line", line).Debug("invalid graphite value")
+		return
+	}
+	ts, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		graphiteParseErrors.WithLabelValues(b.protocol, reasonInvalidTimestamp).Inc()
+		logrus.WithField("line", line).Debug("invalid graphite timestamp")
+		return
+	}
+	b.add(fields[0], value, ts)
+}
+
+func (b *graphiteBatch) add(path string, value, ts float64) {
+	labels, keep := mapGraphitePath(path)
+	graphiteSamples.WithLabelValues(b.protocol).Inc()
+	if !keep {
+		return
+	}
+
+	timestamp := b.now().UnixNano() / int64(time.Millisecond)
+	if ts != -1 {
+		timestamp = int64(math.Round(ts * 1000))
+	}
+	sample := prompb.Sample{Value: value, Timestamp: timestamp}
+
+	b.samples++
+	h := hashLabels(labels)
+	if i, ok := b.series[h]; ok {
+		b.req.Timeseries[i].Samples = append(b.req.Timeseries[i].Samples, sample)
+		return
+	}
+	b.series[h] = len(b.req.Timeseries)
+	b.req.Timeseries = append(b.req.Timeseries, prompb.TimeSeries{Labels: labels, Samples: []prompb.Sample{sample}})
+}
+
+// addPickle parses a pickled list of (path, (timestamp, value)) tuples.
+func (b *graphiteBatch) addPickle(payload []byte) error {
+	b.size += len(payload)
+	decoded, err := pickle.NewDecoder(bytes.NewReader(payload)).Decode()
+	if err != nil {
+		return err
+	}
+	list, ok := decoded.([]interface{})
+	if !ok {
+		return fmt.Errorf("unexpected pickle of %T", decoded)
+	}
+	for _, item := range list {
+		metric, ok := item.(pickle.Tuple)
+		if !ok || len(metric) != 2 {
+			return fmt.Errorf("unexpected metric %v", item)
+		}
+		path, ok := metric[0].(string)
+		point, ok2 := metric[1].(pickle.Tuple)
+		if !ok || !ok2 || len(point) != 2 {
+			return fmt.Errorf("unexpected metric %v", item)
+		}
+		ts, err := pickleNumber(point[0])
+		if err != nil {
+			return fmt.Errorf("invalid timestamp of %s: %s", path, err)
+		}
+		value, err := pickleNumber(point[1])
+		if err != nil {
+			return fmt.Errorf("invalid value of %s: %s", path, err)
+		}
+		b.add(path, value, ts)
+	}
+	return nil
+}
+
+func pickleNumber(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case int64:
+		return float64(n), nil
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(n).Float64()
+		return f, nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	case pickle.Bytes:
+		return strconv.ParseFloat(string(n), 64)
+	}
+	return 0, fmt.Errorf("unexpected %T", v)
+}
+
+// graphiteListener ingests the samples sent in the graphite plaintext and
+// pickle protocols.
+type graphiteListener struct {
+	serializer    Serializer
+	tenant        string
+	maxLineLength int
+	idleTimeout   time.Duration
+	connections   chan struct{}
+}
+
+func newGraphiteListener(serializer Serializer, tenant string, maxConnections, maxLineLength int, idleTimeout time.Duration) *graphiteListener {
+	return &graphiteListener{
+		serializer:    serializer,
+		tenant:        tenant,
+		maxLineLength: maxLineLength,
+		idleTimeout:   idleTimeout,
+		connections:   make(chan struct{}, maxConnections),
+	}
+}
+
+// waitRead sets the deadline of the next read of a connection, so idle
+// clients don't hold a connection slot forever.
+func (l *graphiteListener) waitRead(conn net.Conn) {
+	if l.idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(l.idleTimeout))
+	}
+}
+
+// logClosed logs why a connection is being closed, if it wasn't by the client.
+func logClosed(err error, remoteAddr string) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		logrus.WithField("remote_addr", remoteAddr).Debug("closing idle graphite connection")
+	} else if err != io.EOF {
+		logrus.WithError(err).WithField("remote_addr", remoteAddr).Debug("graphite connection failed")
+	}
+}
+
+// flush ingests the samples of a batch and empties it.
+func (l *graphiteListener) flush(b *graphiteBatch, remoteAddr string) {
+	if len(b.req.Timeseries) == 0 {
+		return
+	}
+	meta := requestMeta{requestID: newRequestID(), remoteAddr: remoteAddr, tenant: l.tenant}
+	if _, err := ingest(l.serializer, b.req, meta, nil, b.size); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"protocol": b.protocol, "remote_addr": remoteAddr}).Error("couldn't ingest graphite samples")
+	}
+	b.req, b.series, b.samples, b.size = &prompb.WriteRequest{}, map[uint64]int{}, 0, 0
+}
+
+// serveTCP accepts connections up to the connection limit, closing the
+// others right away.
+func (l *graphiteListener) serveTCP(ln net.Listener, protocol string, handle func(net.Conn)) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		select {
+		case l.connections <- struct{}{}:
+		default:
+			graphiteRejectedConnections.WithLabelValues(protocol).Inc()
+			logrus.WithField("remote_addr", conn.RemoteAddr().String()).Warn("too many graphite connections, closing")
+			conn.Close()
+			continue
+		}
+
+		graphiteConnections.WithLabelValues(protocol).Inc()
+		go func() {
+			defer func() {
+				conn.Close()
+				<-l.connections
+				graphiteConnections.WithLabelValues(protocol).Dec()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// handlePlaintext reads the lines of a connection, ingesting them whenever
+// no more data is pending or the batch is full. Lines longer than the limit
+// are skipped.
+func (l *graphiteListener) handlePlaintext(conn net.Conn) {
+	remoteAddr := conn.RemoteAddr().String()
+	reader := bufio.NewReaderSize(conn, l.maxLineLength)
+	batch := newGraphiteBatch(graphiteTCP)
+	defer l.flush(batch, remoteAddr)
+
+	for {
+		l.waitRead(conn)
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			graphiteParseErrors.WithLabelValues(graphiteTCP, reasonLineTooLong).Inc()
+			for err == bufio.ErrBufferFull {
+				l.waitRead(conn)
+				_, err = reader.ReadSlice('\n')
+			}
+			if err != nil {
+				logClosed(err, remoteAddr)
+				return
+			}
+			continue
+		}
+		if len(line) > 0 {
+			batch.addLine(string(line))
+		}
+		if err != nil {
+			logClosed(err, remoteAddr)
+			return
+		}
+		if reader.Buffered() == 0 || batch.samples >= graphiteBatchSize {
+			l.flush(batch, remoteAddr)
+		}
+	}
+}
+
+// handlePickle reads the length-prefixed pickle messages of a connection.
+func (l *graphiteListener) handlePickle(conn net.Conn) {
+	remoteAddr := conn.RemoteAddr().String()
+	reader := bufio.NewReader(conn)
+	batch := newGraphiteBatch(graphitePickle)
+
+	for {
+		var length uint32
+		l.waitRead(conn)
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			logClosed(err, remoteAddr)
+			return
+		}
+		if length > graphitePickleMaxSize {
+			graphiteParseErrors.WithLabelValues(graphitePickle, reasonInvalidPickle).Inc()
+			logrus.WithFields(logrus.Fields{"remote_addr": remoteAddr, "size": length}).Warn("graphite pickle message too large, closing")
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			logClosed(err, remoteAddr)
+			return
+		}
+		if err := batch.addPickle(payload); err != nil {
+			graphiteParseErrors.WithLabelValues(graphitePickle, reasonInvalidPickle).Inc()
+			logrus.WithError(err).WithField("remote_addr", remoteAddr).Debug("invalid graphite pickle message")
+		}
+		l.flush(batch, remoteAddr)
+	}
+}
+
+// serveUDP ingests the lines of every packet.
+func (l *graphiteListener) serveUDP(conn net.PacketConn) error {
+	buf := make([]byte, 65536)
+	batch := newGraphiteBatch(graphiteUDP)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if len(line) > l.maxLineLength {
+				graphiteParseErrors.WithLabelValues(graphiteUDP, reasonLineTooLong).Inc()
+				continue
+			}
+			batch.addLine(line)
+		}
+		l.flush(batch, addr.String())
+	}
+}
+
+// startGraphite starts the configured graphite listeners.
+func startGraphite(serializer Serializer) error {
+	if graphiteMappingFile != "" {
+		mappings, err := loadGraphiteMappings(graphiteMappingFile)
+		if err != nil {
+			return err
+		}
+		setGraphiteMappings(mappings)
+		registerReload("graphite-mapping", []string{graphiteMappingFile}, func() error {
+			mappings, err := loadGraphiteMappings(graphiteMappingFile)
+			if err != nil {
+				return err
+			}
+			setGraphiteMappings(mappings)
+			return nil
+		})
+	}
+
+	tenant := graphiteTenant
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	l := newGraphiteListener(serializer, tenant, graphiteMaxConnections, graphiteMaxLineLength, graphiteIdleTimeout)
+
+	if graphiteListenAddress != "" {
+		ln, err := net.Listen("tcp", graphiteListenAddress)
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenPacket("udp", graphiteListenAddress)
+		if err != nil {
+			return err
+		}
+		go func() {
+			logrus.WithError(l.serveTCP(ln, graphiteTCP, l.handlePlaintext)).Fatal("graphite tcp listener stopped")
+		}()
+		go func() {
+			logrus.WithError(l.serveUDP(conn)).Fatal("graphite udp listener stopped")
+		}()
+		logrus.WithField("address", graphiteListenAddress).Info("listening for graphite plaintext")
+	}
+
+	if graphitePickleListenAddress != "" {
+		ln, err := net.Listen("tcp", graphitePickleListenAddress)
+		if err != nil {
+			return err
+		}
+		go func() {
+			logrus.WithError(l.serveTCP(ln, graphitePickle, l.handlePickle)).Fatal("graphite pickle listener stopped")
+		}()
+		logrus.WithField("address", graphitePickleListenAddress).Info("listening for graphite pickle")
+	}
+	return nil
+}
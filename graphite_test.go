@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	pickle "github.com/kisielk/og-rek"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+const graphiteTestMappings = `
+mappings:
+  - match: 'servers.*.cpu.*'
+    name: cpu_usage
+    labels: {host: $1, mode: $2, source: graphite}
+  - match: 'servers\.([^.]+)\.disk\.(.+)'
+    match_type: regex
+    name: disk_${2}_bytes
+    labels: {host: $1}
+  - match: 'debug.*'
+    action: drop
+`
+
+func TestMapGraphitePath(t *testing.T) {
+	mappings, err := parseGraphiteMappings([]byte(graphiteTestMappings))
+	assert.Nil(t, err)
+	setGraphiteMappings(mappings)
+	defer setGraphiteMappings(nil)
+
+	labels, keep := mapGraphitePath("servers.web-1.cpu.user")
+	assert.True(t, keep)
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "cpu_usage"}, {Name: "host", Value: "web-1"}, {Name: "mode", Value: "user"}, {Name: "source", Value: "graphite"}}, labels)
+
+	labels, _ = mapGraphitePath("servers.web-1.disk.used")
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "disk_used_bytes"}, {Name: "host", Value: "web-1"}}, labels)
+
+	labels, _ = mapGraphitePath("app.requests.count;env=prod;dc=eu")
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "app_requests_count"}, {Name: "dc", Value: "eu"}, {Name: "env", Value: "prod"}}, labels)
+
+	_, keep = mapGraphitePath("debug.anything")
+	assert.False(t, keep)
+
+	// A glob star doesn't span path components.
+	labels, _ = mapGraphitePath("servers.web.1.cpu.user")
+	assert.Equal(t, "servers_web_1_cpu_user", labels[0].Value)
+
+	for _, invalid := range []string{
+		"mappings: [{name: x}]",
+		"mappings: [{match: a.*}]",
+		"mappings: [{match: a.*, name: x, match_type: fuzzy}]",
+		"mappings: [{match: '(', name: x, match_type: regex}]",
+		"mappings: [{match: a.*, name: x, labels: {__name__: y}}]",
+	} {
+		_, err := parseGraphiteMappings([]byte(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestGraphiteBatch(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	batch := newGraphiteBatch(graphiteTCP)
+	batch.now = func() time.Time { return now }
+
+	invalidLines := testutil.ToFloat64(graphiteParseErrors.WithLabelValues(graphiteTCP, reasonInvalidLine))
+	invalidValues := testutil.ToFloat64(graphiteParseErrors.WithLabelValues(graphiteTCP, reasonInvalidValue))
+
+	batch.addLine("app.latency 12.5 1600000000\n")
+	batch.addLine("app.latency 13 1600000010.5\n")
+	batch.addLine("app.up 1 -1\n")
+	batch.addLine("app.broken 1\n")
+	batch.addLine("app.broken one 1600000000\n")
+	batch.addLine("\n")
+
+	assert.Equal(t, 3, batch.samples)
+	assert.Equal(t, []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "app_latency"}},
+			Samples: []prompb.Sample{{Value: 12.5, Timestamp: 1600000000000}, {Value: 13, Timestamp: 1600000010500}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "app_up"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1700000000000}},
+		},
+	}, batch.req.Timeseries)
+	assert.Equal(t, invalidLines+1, testutil.ToFloat64(graphiteParseErrors.WithLabelValues(graphiteTCP, reasonInvalidLine)))
+	assert.Equal(t, invalidValues+1, testutil.ToFloat64(graphiteParseErrors.WithLabelValues(graphiteTCP, reasonInvalidValue)))
+}
+
+func TestGraphitePickle(t *testing.T) {
+	var buf bytes.Buffer
+	err := pickle.NewEncoder(&buf).Encode([]interface{}{
+		pickle.Tuple{"app.latency", pickle.Tuple{int64(1600000000), 12.5}},
+		pickle.Tuple{"app.requests", pickle.Tuple{1600000000.5, int64(42)}},
+	})
+	assert.Nil(t, err)
+
+	batch := newGraphiteBatch(graphitePickle)
+	assert.Nil(t, batch.addPickle(buf.Bytes()))
+	assert.Equal(t, []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "app_latency"}},
+			Samples: []prompb.Sample{{Value: 12.5, Timestamp: 1600000000000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "app_requests"}},
+			Samples: []prompb.Sample{{Value: 42, Timestamp: 1600000000500}},
+		},
+	}, batch.req.Timeseries)
+
+	buf.Reset()
+	assert.Nil(t, pickle.NewEncoder(&buf).Encode(map[interface{}]interface{}{"a": 1}))
+	assert.NotNil(t, batch.addPickle(buf.Bytes()))
+	assert.NotNil(t, batch.addPickle([]byte("garbage")))
+}
+
+func TestGraphiteIdleTimeout(t *testing.T) {
+	l := newGraphiteListener(nil, "", 1, 4096, 50*time.Millisecond)
+	for _, handle := range []func(net.Conn){l.handlePlaintext, l.handlePickle} {
+		server, client := net.Pipe()
+		closed := make(chan struct{})
+		go func() {
+			handle(server)
+			close(closed)
+		}()
+
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("idle connection not closed")
+		}
+		client.Close()
+		server.Close()
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -29,11 +30,16 @@ import (
 	"github.com/prometheus/prometheus/prompb"
 )
 
-func receiveHandler(producer *kafka.Producer, serializer Serializer) func(c *gin.Context) {
+func receiveHandler(serializer Serializer) func(c *gin.Context) {
 	return func(c *gin.Context) {
 
 		httpRequestsTotal.Add(float64(1))
 
+		meta, ok := ingestMeta(c)
+		if !ok {
+			return
+		}
+
 		compressed, err := ioutil.ReadAll(c.Request.Body)
 		if err != nil {
 			c.AbortWithStatus(http.StatusInternalServerError)
@@ -55,35 +61,163 @@ func receiveHandler(producer *kafka.Producer, serializer Serializer) func(c *gin
 			return
 		}
 
-		metricsPerTopic, err := processWriteRequest(&req)
-		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
-			logrus.WithError(err).Error("couldn't process write request")
-			return
+		status, err := ingest(serializer, &req, meta, requestIdentity(c), len(reqBuf))
+		respondIngest(c, status, err)
+	}
+}
+
+// ingestMeta resolves the tenant and provenance of an ingestion request,
+// answering it when the tenant is missing or invalid.
+func ingestMeta(c *gin.Context) (requestMeta, bool) {
+	tenant, err := tenantFromRequest(c)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == errMissingTenant {
+			status = http.StatusUnauthorized
+		} else if _, ok := err.(*forbiddenTenantError); ok {
+			status = http.StatusForbidden
+			authFailures.WithLabelValues(reasonForbiddenTenant).Inc()
+		}
+		c.String(status, err.Error())
+		c.Abort()
+		logrus.WithError(err).Error("couldn't find the tenant of the request")
+		return requestMeta{}, false
+	}
+	return newRequestMeta(c, tenant), true
+}
+
+// respondIngest answers a request with the outcome of ingest.
+func respondIngest(c *gin.Context, status int, err error) {
+	if err != nil {
+		c.String(status, err.Error())
+		c.Abort()
+		return
+	}
+	c.Status(status)
+}
+
+// ingest runs the samples of a request through the pipeline shared by every
+// ingestion endpoint: HA deduplication, limits, filtering, routing,
+// forwarding and production. It returns the http status the request must be
+// answered with, along with the error when it failed.
+func ingest(serializer Serializer, req *prompb.WriteRequest, meta requestMeta, id *identity, size int) (int, error) {
+	if haDedup != nil && !haDedup.accept(meta.tenant, req, time.Now()) {
+		return http.StatusAccepted, nil
+	}
+
+	// Rate limits are retryable, unlike the series limit, which only frees up
+	// once series become inactive.
+	limitErr := applyLimits(meta.tenant, req, size)
+	if limitErr != nil && len(req.Timeseries) == 0 {
+		logrus.WithError(limitErr).Warn("request rejected by the tenant limits")
+		if limitErr.(*limitError).reason == reasonSeriesLimit {
+			return http.StatusBadRequest, limitErr
+		}
+		return http.StatusTooManyRequests, limitErr
+	}
+
+	metricsPerTopic, err := processWriteRequest(req, meta.tenant)
+	if err != nil {
+		logrus.WithError(err).Error("couldn't process write request")
+		return http.StatusInternalServerError, err
+	}
+
+	for d := range metricsPerTopic {
+		topic := d.topic
+		if !requestAuth.authorizeTopic(id, topic) {
+			authFailures.WithLabelValues(reasonForbiddenTopic).Inc()
+			logrus.WithFields(logrus.Fields{"principal": id.principal, "topic": topic}).Warn("forbidden topic")
+			return http.StatusForbidden, fmt.Errorf("principal %q is not allowed to write to topic %q", id.principal, topic)
+		}
+	}
+
+	// Requests fail fast when a required destination can't be produced to
+	// because its circuit breaker is open. Their trials of half-open breakers
+	// are sealed once everything is produced.
+	now := time.Now()
+	producers := make(map[destination]*reloadableProducer, len(metricsPerTopic))
+	trials := make(map[destination]*breakerTrial, len(metricsPerTopic))
+	defer func() {
+		for _, trial := range trials {
+			trial.seal()
+		}
+	}()
+	for d := range metricsPerTopic {
+		producer, trial := producerFor(d, now)
+		if trial != nil {
+			trials[d] = trial
+		}
+		if producer == nil && !d.optional {
+			logrus.WithFields(logrus.Fields{"sink": d.sink, "topic": d.topic}).Debug("request rejected by an open circuit breaker")
+			return http.StatusServiceUnavailable, fmt.Errorf("circuit breaker open for topic %q of sink %q", d.topic, d.sink)
+		}
+		producers[d] = producer
+	}
+
+	// The headers describing the format depend on the serializer of each
+	// destination.
+	headersPerSerializer := map[Serializer][]kafka.Header{}
+
+	for d, metrics := range metricsPerTopic {
+		topic := d.topic
+		producer := producers[d]
+		if producer == nil {
+			continue
+		}
+		part := kafka.TopicPartition{
+			Partition: kafka.PartitionAny,
+			Topic:     &topic,
+		}
+
+		s := serializer
+		if d.serializer != nil {
+			s = d.serializer
+		}
+		headers, ok := headersPerSerializer[s]
+		if !ok {
+			headers = requestHeaders(s, meta)
+			headersPerSerializer[s] = headers
 		}
 
-		for topic, metrics := range metricsPerTopic {
-			t := topic
-			part := kafka.TopicPartition{
-				Partition: kafka.PartitionAny,
-				Topic:     &t,
+		for _, metric := range metrics {
+			objectsWritten.Add(float64(1))
+			sinkProduced.WithLabelValues(producer.name).Inc()
+			msg := &kafka.Message{
+				TopicPartition: part,
+				Value:          metric.value,
+				Headers:        messageHeaders(headers, metric.headers),
 			}
-			for _, metric := range metrics {
-				objectsWritten.Add(float64(1))
-				err := producer.Produce(&kafka.Message{
-					TopicPartition: part,
-					Value:          metric,
-				}, nil)
-
-				if err != nil {
-					objectsFailed.Add(float64(1))
-					c.AbortWithStatus(http.StatusInternalServerError)
-					logrus.WithError(err).Debug(fmt.Sprintf("Failing metric %v", metric))
-					logrus.WithError(err).Error(fmt.Sprintf("couldn't produce message in kafka topic %v", topic))
-					return
+			trials[d].track(msg)
+			err := producer.Produce(msg)
+
+			if err != nil {
+				objectsFailed.Add(float64(1))
+				sinkFailed.WithLabelValues(producer.name).Inc()
+				recordDelivery(producer.name, msg, false)
+				logrus.WithError(err).Debug(fmt.Sprintf("Failing metric %v", metric.value))
+				logrus.WithError(err).WithField("sink", producer.name).Error(fmt.Sprintf("couldn't produce message in kafka topic %v", topic))
+				if d.optional {
+					// Failures of optional outputs don't affect the
+					// others, the rest of the batch is skipped.
+					break
 				}
+				return http.StatusInternalServerError, fmt.Errorf("couldn't produce message in kafka topic %v: %s", topic, err)
 			}
 		}
+	}
+
+	// Requests are forwarded once produced, so a retry of a failed request
+	// doesn't forward its samples twice.
+	forwardWriteRequest(req, meta.tenant)
+	if remoteReadBuffer != nil {
+		remoteReadBuffer.appendRequest(meta.tenant, req)
+	}
 
+	if limitErr != nil {
+		// The admitted series were written, so the request must not be
+		// retried: Prometheus doesn't retry a 400.
+		logrus.WithError(limitErr).Warn("request partially rejected by the tenant limits")
+		return http.StatusBadRequest, limitErr
 	}
+	return http.StatusOK, nil
 }
@@ -0,0 +1,177 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// haTracker deduplicates the samples sent by Prometheus HA pairs. For every
+// cluster one replica is elected as leader and only its samples are accepted,
+// another replica takes over when the leader has sent nothing for the failover
+// timeout.
+type haTracker struct {
+	mu              sync.Mutex
+	clusterLabel    string
+	replicaLabel    string
+	failoverTimeout time.Duration
+	elected         map[haClusterKey]*haReplica
+}
+
+type haClusterKey struct {
+	tenant  string
+	cluster string
+}
+
+type haReplica struct {
+	replica   string
+	electedAt time.Time
+	lastSeen  time.Time
+}
+
+func newHATracker(clusterLabel, replicaLabel string, failoverTimeout time.Duration) *haTracker {
+	return &haTracker{
+		clusterLabel:    clusterLabel,
+		replicaLabel:    replicaLabel,
+		failoverTimeout: failoverTimeout,
+		elected:         make(map[haClusterKey]*haReplica),
+	}
+}
+
+// accept checks whether the request comes from the elected replica of its
+// cluster, electing it when the cluster has no live leader. Requests without
+// the cluster and replica labels are always accepted. The replica label is
+// removed from accepted requests.
+func (t *haTracker) accept(tenant string, req *prompb.WriteRequest, now time.Time) bool {
+	if len(req.Timeseries) == 0 {
+		return true
+	}
+
+	// Every series of a request comes from the same Prometheus, so they all
+	// share the same external labels.
+	cluster, replica := t.findLabels(req.Timeseries[0].Labels)
+	if cluster == "" || replica == "" {
+		return true
+	}
+
+	if !t.checkReplica(haClusterKey{tenant: tenant, cluster: cluster}, replica, now) {
+		samples := 0
+		for _, ts := range req.Timeseries {
+			samples += len(ts.Samples)
+		}
+		dedupedSamples.WithLabelValues(tenant, cluster).Add(float64(samples))
+		return false
+	}
+
+	for i := range req.Timeseries {
+		req.Timeseries[i].Labels = removeLabel(req.Timeseries[i].Labels, t.replicaLabel)
+	}
+	return true
+}
+
+func (t *haTracker) findLabels(labels []prompb.Label) (cluster, replica string) {
+	for _, l := range labels {
+		switch l.Name {
+		case t.clusterLabel:
+			cluster = l.Value
+		case t.replicaLabel:
+			replica = l.Value
+		}
+	}
+	return cluster, replica
+}
+
+func (t *haTracker) checkReplica(key haClusterKey, replica string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elected, ok := t.elected[key]
+	switch {
+	case ok && elected.replica == replica:
+		elected.lastSeen = now
+		return true
+	case ok && now.Sub(elected.lastSeen) < t.failoverTimeout:
+		return false
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"tenant":  key.tenant,
+		"cluster": key.cluster,
+		"replica": replica,
+	}).Info("electing new HA replica")
+
+	if ok {
+		haElectedReplica.DeleteLabelValues(key.tenant, key.cluster, elected.replica)
+	}
+	t.elected[key] = &haReplica{replica: replica, electedAt: now, lastSeen: now}
+	haElectedReplica.WithLabelValues(key.tenant, key.cluster, replica).Set(1)
+	haElectedReplicaChanges.WithLabelValues(key.tenant, key.cluster).Inc()
+	return true
+}
+
+// haElection describes the elected replica of a cluster.
+type haElection struct {
+	Tenant    string    `json:"tenant"`
+	Cluster   string    `json:"cluster"`
+	Replica   string    `json:"replica"`
+	ElectedAt time.Time `json:"electedAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+func (t *haTracker) elections() []haElection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elections := make([]haElection, 0, len(t.elected))
+	for key, r := range t.elected {
+		elections = append(elections, haElection{
+			Tenant:    key.tenant,
+			Cluster:   key.cluster,
+			Replica:   r.replica,
+			ElectedAt: r.electedAt,
+			LastSeen:  r.lastSeen,
+		})
+	}
+	sort.Slice(elections, func(i, j int) bool {
+		if elections[i].Tenant != elections[j].Tenant {
+			return elections[i].Tenant < elections[j].Tenant
+		}
+		return elections[i].Cluster < elections[j].Cluster
+	})
+	return elections
+}
+
+// haTrackerHandler lists the elected replica of every cluster.
+func haTrackerHandler(t *haTracker) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"elections": t.elections()})
+	}
+}
+
+func removeLabel(labels []prompb.Label, name string) []prompb.Label {
+	for i, l := range labels {
+		if l.Name == name {
+			return append(labels[:i:i], labels[i+1:]...)
+		}
+	}
+	return labels
+}
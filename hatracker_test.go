@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func haWriteRequest(replica string) *prompb.WriteRequest {
+	return &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels: []prompb.Label{
+					{Name: "__name__", Value: "foo"},
+					{Name: "__replica__", Value: replica},
+					{Name: "cluster", Value: "eu-1"},
+				},
+				Samples: []prompb.Sample{{Timestamp: 0, Value: 1}},
+			},
+		},
+	}
+}
+
+func TestHATracker(t *testing.T) {
+	now := time.Unix(0, 0)
+	tracker := newHATracker("cluster", "__replica__", 30*time.Second)
+
+	req := haWriteRequest("a")
+	assert.True(t, tracker.accept("", req, now))
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "foo"},
+		{Name: "cluster", Value: "eu-1"},
+	}, req.Timeseries[0].Labels, "replica label is removed")
+
+	assert.False(t, tracker.accept("", haWriteRequest("b"), now.Add(10*time.Second)))
+	assert.True(t, tracker.accept("", haWriteRequest("a"), now.Add(20*time.Second)))
+	assert.True(t, tracker.accept("other-tenant", haWriteRequest("b"), now.Add(20*time.Second)))
+
+	assert.True(t, tracker.accept("", haWriteRequest("b"), now.Add(time.Minute)), "failover after the timeout")
+	assert.False(t, tracker.accept("", haWriteRequest("a"), now.Add(time.Minute)))
+
+	assert.True(t, tracker.accept("", NewWriteRequest(), now), "requests without HA labels are accepted")
+}
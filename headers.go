@@ -0,0 +1,223 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v2"
+)
+
+// Names of the built-in record headers, as accepted by KAFKA_HEADERS.
+const (
+	headerFormat        = "format"
+	headerSchemaVersion = "schema-version"
+	headerContentType   = "content-type"
+	headerInstanceID    = "instance-id"
+	headerTenant        = "tenant"
+	headerRemoteAddr    = "remote-addr"
+	headerRequestID     = "request-id"
+)
+
+var builtinHeaders = []string{
+	headerFormat,
+	headerSchemaVersion,
+	headerContentType,
+	headerInstanceID,
+	headerTenant,
+	headerRemoteAddr,
+	headerRequestID,
+}
+
+// requestIDHeader is the HTTP header used to propagate a request ID from the
+// client, a new one is generated when it is missing.
+const requestIDHeader = "X-Request-ID"
+
+// describer is implemented by serializers that are able to describe the
+// records they produce.
+type describer interface {
+	Format() string
+	ContentType() string
+	SchemaVersion() string
+}
+
+// requestMeta holds the provenance of a write request, attached to every
+// record produced for it.
+type requestMeta struct {
+	requestID  string
+	remoteAddr string
+	tenant     string
+}
+
+func newRequestMeta(c *gin.Context, tenant string) requestMeta {
+	requestID := c.GetHeader(requestIDHeader)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+
+	return requestMeta{
+		requestID:  requestID,
+		remoteAddr: c.Request.RemoteAddr,
+		tenant:     tenant,
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestHeaders builds the headers shared by all the records of a request:
+// the enabled built-in headers followed by the static ones.
+func requestHeaders(s Serializer, meta requestMeta) []kafka.Header {
+	var headers []kafka.Header
+
+	add := func(key, value string) {
+		if value != "" {
+			headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+		}
+	}
+
+	d, _ := s.(describer)
+	for _, name := range kafkaHeaders {
+		switch name {
+		case headerFormat:
+			if d != nil {
+				add(name, d.Format())
+			}
+		case headerSchemaVersion:
+			if d != nil {
+				add(name, d.SchemaVersion())
+			}
+		case headerContentType:
+			if d != nil {
+				add(name, d.ContentType())
+			}
+		case headerInstanceID:
+			add(name, instanceID)
+		case headerTenant:
+			add(name, meta.tenant)
+		case headerRemoteAddr:
+			add(name, meta.remoteAddr)
+		case headerRequestID:
+			add(name, meta.requestID)
+		}
+	}
+
+	return append(headers, kafkaStaticHeaders...)
+}
+
+// labelHeader is a record header whose value is rendered from the labels of
+// each series.
+type labelHeader struct {
+	key      string
+	template *template.Template
+}
+
+// labelHeaders renders the label templated headers for a series.
+func labelHeaders(labels map[string]string) []kafka.Header {
+	if len(kafkaLabelHeaders) == 0 {
+		return nil
+	}
+
+	headers := make([]kafka.Header, 0, len(kafkaLabelHeaders))
+	for _, h := range kafkaLabelHeaders {
+		var buf bytes.Buffer
+		if err := h.template.Execute(&buf, labels); err != nil || buf.Len() == 0 {
+			continue
+		}
+		headers = append(headers, kafka.Header{Key: h.key, Value: buf.Bytes()})
+	}
+	return headers
+}
+
+func parseHeaderList(text string) ([]string, error) {
+	var headers []string
+	for _, name := range strings.Split(text, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		switch {
+		case name == "":
+			continue
+		case name == "all":
+			headers = append(headers, builtinHeaders...)
+		case contains(builtinHeaders, name):
+			headers = append(headers, name)
+		default:
+			return nil, fmt.Errorf("unknown header %q, must be one of %s", name, strings.Join(builtinHeaders, ", "))
+		}
+	}
+	return headers, nil
+}
+
+func parseStaticHeaders(text string) ([]kafka.Header, error) {
+	var definitions map[string]string
+	if err := yaml.Unmarshal([]byte(text), &definitions); err != nil {
+		return nil, err
+	}
+
+	headers := make([]kafka.Header, 0, len(definitions))
+	for key, value := range definitions {
+		headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Key < headers[j].Key })
+	return headers, nil
+}
+
+func parseLabelHeaders(text string) ([]labelHeader, error) {
+	var definitions map[string]string
+	if err := yaml.Unmarshal([]byte(text), &definitions); err != nil {
+		return nil, err
+	}
+
+	headers := make([]labelHeader, 0, len(definitions))
+	for key, tpl := range definitions {
+		t, err := parseTopicTemplate(tpl)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse template for header %q: %s", key, err)
+		}
+		headers = append(headers, labelHeader{key: key, template: t})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].key < headers[j].key })
+	return headers, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// messageHeaders merges the request headers with the ones of a record.
+func messageHeaders(request, record []kafka.Header) []kafka.Header {
+	if len(record) == 0 {
+		return request
+	}
+	headers := make([]kafka.Header, 0, len(request)+len(record))
+	return append(append(headers, request...), record...)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProducedHeaders(t *testing.T) {
+	defer func(headers []string, static []kafka.Header, labels []labelHeader, id string) {
+		kafkaHeaders, kafkaStaticHeaders, kafkaLabelHeaders, instanceID = headers, static, labels, id
+		delete(sinkProducers, defaultSinkName)
+	}(kafkaHeaders, kafkaStaticHeaders, kafkaLabelHeaders, instanceID)
+
+	var err error
+	kafkaHeaders, err = parseHeaderList("all")
+	assert.Nil(t, err)
+	kafkaStaticHeaders, err = parseStaticHeaders("{env: prod, dc: eu-1}")
+	assert.Nil(t, err)
+	kafkaLabelHeaders, err = parseLabelHeaders(`{metric: '{{ index . "__name__" }}', job: '{{ index . "job" }}'}`)
+	assert.Nil(t, err)
+	instanceID = "adapter-0"
+
+	fake := newFakeProducer(false)
+	sinkProducers[defaultSinkName] = newTestProducer(t, fake)
+	meta := requestMeta{requestID: "req-1", remoteAddr: "10.0.0.1:4321", tenant: "team-a"}
+
+	// produce ingests a request and returns the headers of its records.
+	produce := func() [][]kafka.Header {
+		status, err := ingest(serializer, NewWriteRequest(), meta, nil, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, status)
+
+		var headers [][]kafka.Header
+		for len(fake.produced) > 0 {
+			headers = append(headers, (<-fake.produced).Headers)
+		}
+		return headers
+	}
+	header := func(key, value string) kafka.Header {
+		return kafka.Header{Key: key, Value: []byte(value)}
+	}
+
+	// Built-in headers come first, the empty ones being skipped, then the
+	// static headers and the headers rendered from the labels.
+	headers := produce()
+	assert.Len(t, headers, 2, "one record per sample")
+	for _, h := range headers {
+		assert.Equal(t, []kafka.Header{
+			header("format", "json"),
+			header("content-type", "application/json"),
+			header("instance-id", "adapter-0"),
+			header("tenant", "team-a"),
+			header("remote-addr", "10.0.0.1:4321"),
+			header("request-id", "req-1"),
+			header("dc", "eu-1"),
+			header("env", "prod"),
+			header("metric", "foo"),
+		}, h)
+	}
+
+	// Only the enabled built-in headers are set.
+	kafkaHeaders, err = parseHeaderList("tenant, request-id")
+	assert.Nil(t, err)
+	kafkaStaticHeaders, kafkaLabelHeaders = nil, nil
+	for _, h := range produce() {
+		assert.Equal(t, []kafka.Header{header("tenant", "team-a"), header("request-id", "req-1")}, h)
+	}
+
+	kafkaHeaders = nil
+	for _, h := range produce() {
+		assert.Empty(t, h)
+	}
+}
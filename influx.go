@@ -0,0 +1,348 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// influxPrecisions maps the precisions accepted by the Influx 1.x and 2.x
+// write APIs to their duration in nanoseconds.
+var influxPrecisions = map[string]int64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  int64(time.Microsecond),
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+}
+
+// influxErrorCodes maps the http statuses to the error codes of the Influx
+// 2.x API.
+var influxErrorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusRequestEntityTooLarge: "request too large",
+	http.StatusTooManyRequests:       "too many requests",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// influxPoint is a parsed line of line protocol. String fields can't be
+// samples and are left out.
+type influxPoint struct {
+	measurement string
+	tags        []prompb.Label
+	fields      []influxField
+	timestamp   int64
+	hasTime     bool
+}
+
+type influxField struct {
+	key   string
+	value float64
+}
+
+// influxHandler accepts writes in Influx line protocol, through the 2.x API
+// or the 1.x one when v1 is set. Every field becomes a sample named after the
+// measurement and the field.
+func influxHandler(serializer Serializer, v1 bool) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		httpRequestsTotal.Add(float64(1))
+
+		meta, ok := ingestMeta(c)
+		if !ok {
+			return
+		}
+
+		precision, ok := influxPrecisions[c.Query("precision")]
+		if !ok {
+			influxError(c, v1, http.StatusBadRequest, fmt.Sprintf("invalid precision %q", c.Query("precision")))
+			return
+		}
+
+		var body io.Reader = c.Request.Body
+		if c.GetHeader("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				influxError(c, v1, http.StatusBadRequest, "couldn't decompress body: "+err.Error())
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+		buf, err := ioutil.ReadAll(body)
+		if err != nil {
+			influxError(c, v1, http.StatusBadRequest, "couldn't read body: "+err.Error())
+			return
+		}
+
+		req, lineErrors := influxToWriteRequest(buf, precision, time.Now())
+		if len(req.Timeseries) > 0 {
+			status, err := ingest(serializer, req, meta, requestIdentity(c), len(buf))
+			if err != nil {
+				influxError(c, v1, status, err.Error())
+				return
+			}
+		}
+
+		// Influx writes the valid lines and reports the others.
+		if len(lineErrors) > 0 {
+			msg := strings.Join(lineErrors, "; ")
+			if len(req.Timeseries) > 0 {
+				msg = "partial write: " + msg
+			}
+			logrus.WithField("errors", len(lineErrors)).Warn("couldn't parse line protocol")
+			influxError(c, v1, http.StatusBadRequest, msg)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// influxError answers with the error body the Influx clients expect.
+func influxError(c *gin.Context, v1 bool, status int, msg string) {
+	if v1 {
+		c.JSON(status, gin.H{"error": msg})
+	} else {
+		code, ok := influxErrorCodes[status]
+		if !ok {
+			code = "internal error"
+		}
+		c.JSON(status, gin.H{"code": code, "message": msg})
+	}
+	c.Abort()
+}
+
+// influxToWriteRequest parses a body in line protocol, returning the error
+// of every line that couldn't be parsed. Points without timestamp take the
+// time of the request.
+func influxToWriteRequest(body []byte, precision int64, now time.Time) (*prompb.WriteRequest, []string) {
+	req := &prompb.WriteRequest{}
+	series := map[uint64]int{}
+	var lineErrors []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p, err := parseInfluxLine(line)
+		if err != nil {
+			lineErrors = append(lineErrors, fmt.Sprintf("unable to parse line %d %q: %s", n, line, err))
+			continue
+		}
+
+		ts := now.UnixNano() / int64(time.Millisecond)
+		if p.hasTime {
+			ts = p.timestamp * precision / int64(time.Millisecond)
+		}
+		for _, f := range p.fields {
+			labels := make([]prompb.Label, 0, len(p.tags)+1)
+			labels = append(labels, prompb.Label{Name: "__name__", Value: sanitizeMetricName(p.measurement + "_" + f.key)})
+			labels = append(labels, p.tags...)
+			sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+			sample := prompb.Sample{Value: f.value, Timestamp: ts}
+			h := hashLabels(labels)
+			if i, ok := series[h]; ok {
+				req.Timeseries[i].Samples = append(req.Timeseries[i].Samples, sample)
+				continue
+			}
+			series[h] = len(req.Timeseries)
+			req.Timeseries = append(req.Timeseries, prompb.TimeSeries{Labels: labels, Samples: []prompb.Sample{sample}})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		lineErrors = append(lineErrors, err.Error())
+	}
+	return req, lineErrors
+}
+
+// parseInfluxLine parses a line of line protocol:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func parseInfluxLine(line string) (influxPoint, error) {
+	var p influxPoint
+
+	// Quotes are only special in the field values.
+	keyEnd := -1
+	for i := 0; i < len(line) && keyEnd < 0; i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case ' ':
+			keyEnd = i
+		}
+	}
+	if keyEnd < 0 {
+		return p, errors.New("missing fields")
+	}
+	sections := append([]string{line[:keyEnd]}, splitInfluxLine(line[keyEnd+1:], ' ', true)...)
+	if len(sections) > 3 {
+		return p, errors.New("unexpected content after the timestamp")
+	}
+
+	key := splitInfluxLine(sections[0], ',', false)
+	p.measurement = unescapeInflux(key[0])
+	if p.measurement == "" {
+		return p, errors.New("missing measurement")
+	}
+	// The measurement names the series, so a __name__ tag is dropped, as OTLP
+	// attributes are. Tags can't share a label name once sanitized.
+	tags := map[string]string{}
+	for _, tag := range key[1:] {
+		k, v, err := splitInfluxPair(tag)
+		if err != nil {
+			return p, fmt.Errorf("invalid tag %q: %s", tag, err)
+		}
+		name := sanitizeLabelName(k)
+		if name == "__name__" {
+			continue
+		}
+		if other, ok := tags[name]; ok {
+			return p, fmt.Errorf("tags %q and %q are both written as label %q", other, k, name)
+		}
+		tags[name] = k
+		p.tags = append(p.tags, prompb.Label{Name: name, Value: v})
+	}
+
+	for _, field := range splitInfluxLine(sections[1], ',', true) {
+		k, raw, err := splitInfluxPair(field)
+		if err != nil {
+			return p, fmt.Errorf("invalid field %q: %s", field, err)
+		}
+		if strings.HasPrefix(raw, "\"") {
+			if len(raw) < 2 || !strings.HasSuffix(raw, "\"") {
+				return p, fmt.Errorf("unterminated string field %q", k)
+			}
+			continue
+		}
+		v, err := parseInfluxValue(raw)
+		if err != nil {
+			return p, fmt.Errorf("invalid value of field %q: %s", k, err)
+		}
+		p.fields = append(p.fields, influxField{key: k, value: v})
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		p.timestamp, p.hasTime = ts, true
+	}
+	return p, nil
+}
+
+// parseInfluxValue parses a float, integer, unsigned or boolean field.
+func parseInfluxValue(raw string) (float64, error) {
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	switch {
+	case strings.HasSuffix(raw, "i"):
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		return float64(v), err
+	case strings.HasSuffix(raw, "u"):
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		return float64(v), err
+	}
+	return strconv.ParseFloat(raw, 64)
+}
+
+// splitInfluxLine splits a line on the separator, skipping escaped
+// characters, and the content of quoted strings when quotes is set.
+func splitInfluxLine(s string, sep byte, quotes bool) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"' && quotes:
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// splitInfluxPair splits a key=value pair on the first unescaped equal sign,
+// unescaping the key, and the value unless it is a quoted string.
+func splitInfluxPair(s string) (string, string, error) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '=':
+			key, value := unescapeInflux(s[:i]), s[i+1:]
+			if key == "" {
+				return "", "", errors.New("missing key")
+			}
+			if value == "" {
+				return "", "", errors.New("missing value")
+			}
+			if !strings.HasPrefix(value, "\"") {
+				value = unescapeInflux(value)
+			}
+			return key, value, nil
+		}
+	}
+	return "", "", errors.New("missing equal sign")
+}
+
+// unescapeInflux removes the backslashes escaping commas, equal signs and
+// spaces.
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(", =", s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
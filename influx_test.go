@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInfluxLine(t *testing.T) {
+	p, err := parseInfluxLine(`cpu\ load,host=server\,01,region=eu\ west usage=0.5,cores=8i,up=true,free=3u,note="a, \"quoted\" b=c" 1600000000000000000`)
+	assert.Nil(t, err)
+	assert.Equal(t, influxPoint{
+		measurement: "cpu load",
+		tags:        []prompb.Label{{Name: "host", Value: "server,01"}, {Name: "region", Value: "eu west"}},
+		fields:      []influxField{{"usage", 0.5}, {"cores", 8}, {"up", 1}, {"free", 3}},
+		timestamp:   1600000000000000000,
+		hasTime:     true,
+	}, p)
+
+	p, err = parseInfluxLine(`mem used=1`)
+	assert.Nil(t, err)
+	assert.False(t, p.hasTime)
+
+	p, err = parseInfluxLine(`mem,__name__=other,host=a used=1`)
+	assert.Nil(t, err)
+	assert.Equal(t, []prompb.Label{{Name: "host", Value: "a"}}, p.tags, "the measurement names the series")
+
+	for _, line := range []string{
+		`mem`,
+		`mem used`,
+		`mem used=`,
+		`mem used=abc`,
+		`mem,host used=1`,
+		`mem used=1 notatimestamp`,
+		`mem used=1 1 2`,
+		`mem note="unterminated`,
+		`mem,a-b=1,a.b=2 used=1`,
+		`mem,host=a,host=b used=1`,
+	} {
+		_, err := parseInfluxLine(line)
+		assert.NotNil(t, err, line)
+	}
+}
+
+func TestInfluxToWriteRequest(t *testing.T) {
+	body := []byte("# comment\n" +
+		"disk,host=a,0path=/ used=10,free=20 1600000000\n" +
+		"disk,host=a,0path=/ used=11 1600000010\n" +
+		"bad line\n" +
+		"\n" +
+		"net.io,host=b bytes=5i\n")
+
+	now := time.Unix(1700000000, 0)
+	req, lineErrors := influxToWriteRequest(body, int64(time.Second), now)
+	assert.Equal(t, []string{`unable to parse line 4 "bad line": invalid field "line": missing equal sign`}, lineErrors)
+	assert.Equal(t, []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "disk_used"}, {Name: "host", Value: "a"}, {Name: "key_0path", Value: "/"}},
+			Samples: []prompb.Sample{{Value: 10, Timestamp: 1600000000000}, {Value: 11, Timestamp: 1600000010000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "disk_free"}, {Name: "host", Value: "a"}, {Name: "key_0path", Value: "/"}},
+			Samples: []prompb.Sample{{Value: 20, Timestamp: 1600000000000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "net_io_bytes"}, {Name: "host", Value: "b"}},
+			Samples: []prompb.Sample{{Value: 5, Timestamp: 1700000000000}},
+		},
+	}, req.Timeseries)
+}
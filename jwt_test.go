@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		assert.Nil(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		assert.Nil(t, err)
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTValidator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	b64 := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N), "e": b64(big.NewInt(int64(rsaKey.E)))},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X), "y": b64(ecKey.Y)},
+	}})
+	jwtJWKSFile = filepath.Join(t.TempDir(), "jwks.json")
+	assert.Nil(t, ioutil.WriteFile(jwtJWKSFile, jwks, 0600))
+	jwtIssuer, jwtAudience = "https://issuer", "adapter"
+	defer func() { jwtJWKSFile, jwtIssuer, jwtAudience = "", "", "" }()
+
+	v := &jwtValidator{}
+	assert.Nil(t, v.reload())
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"sub":    "agent-1",
+		"iss":    "https://issuer",
+		"aud":    []string{"adapter", "other"},
+		"exp":    now.Add(time.Hour).Unix(),
+		"tenant": "team-a",
+		"topics": []string{"metrics.team-a.*"},
+	}
+
+	for alg, key := range map[string]crypto.Signer{"RS256": rsaKey, "ES256": ecKey} {
+		kid := map[string]string{"RS256": "rsa", "ES256": "ec"}[alg]
+		result, err := v.validate(signJWT(t, alg, kid, key, claims), now)
+		assert.Nil(t, err, alg)
+		assert.Equal(t, &jwtClaims{principal: "agent-1", tenant: "team-a", topics: []string{"metrics.team-a.*"}}, result)
+	}
+
+	_, err = v.validate(signJWT(t, "ES256", "rsa", ecKey, claims), now)
+	assert.NotNil(t, err, "algorithm must match the key")
+	_, err = v.validate(signJWT(t, "RS256", "unknown", rsaKey, claims), now)
+	assert.Equal(t, errUnknownKey, err)
+	_, err = v.validate(signJWT(t, "RS256", "rsa", rsaKey, claims), now.Add(2*time.Hour))
+	assert.NotNil(t, err, "expired token")
+
+	claims["iss"] = "https://other"
+	_, err = v.validate(signJWT(t, "RS256", "rsa", rsaKey, claims), now)
+	assert.NotNil(t, err, "wrong issuer")
+
+	claims["iss"], claims["aud"] = "https://issuer", "other"
+	_, err = v.validate(signJWT(t, "RS256", "rsa", rsaKey, claims), now)
+	assert.NotNil(t, err, "wrong audience")
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	claims["aud"] = "adapter"
+	_, err = v.validate(signJWT(t, "RS256", "rsa", otherKey, claims), now)
+	assert.NotNil(t, err, "wrong signature")
+}
+
+func TestAuthenticatorEnablesJWT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	b64 := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(key.X), "y": b64(key.Y)},
+	}})
+	token := signJWT(t, "ES256", "ec", key, map[string]interface{}{"sub": "agent-1", "exp": time.Now().Add(time.Hour).Unix()})
+
+	a := newAuthenticator()
+	assert.Nil(t, a.reload())
+	_, reason := a.authenticateToken(token)
+	assert.Equal(t, reasonInvalidToken, reason)
+
+	// Tokens are validated while a reload enables the JWKS.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			a.authenticateToken(token)
+		}
+	}()
+	jwtJWKSFile = filepath.Join(t.TempDir(), "jwks.json")
+	defer func() { jwtJWKSFile = "" }()
+	assert.Nil(t, ioutil.WriteFile(jwtJWKSFile, jwks, 0600))
+	assert.Nil(t, a.reload())
+	<-done
+
+	id, reason := a.authenticateToken(token)
+	assert.Empty(t, reason)
+	assert.Equal(t, "agent-1", id.principal)
+}
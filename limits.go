@@ -0,0 +1,307 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Reasons for discarding samples, used in the discarded_samples_total metric.
+const (
+	reasonRateLimited      = "rate_limited"
+	reasonBytesRateLimited = "bytes_rate_limited"
+	reasonSeriesLimit      = "per_tenant_series_limit"
+)
+
+// tenantLimits holds the ingestion limits of a tenant. Zero values fall back
+// to the defaults, and zero defaults mean unlimited.
+type tenantLimits struct {
+	IngestionRate           float64 `yaml:"ingestion_rate"`
+	IngestionBurstSize      int     `yaml:"ingestion_burst_size"`
+	IngestionBytesRate      float64 `yaml:"ingestion_bytes_rate"`
+	IngestionBytesBurstSize int     `yaml:"ingestion_bytes_burst_size"`
+	MaxSeries               int     `yaml:"max_series"`
+}
+
+// limitsFor returns the effective limits of a tenant.
+func limitsFor(tenant string) tenantLimits {
+	l := defaultLimits
+	o := overridesFor(tenant)
+	if o == nil {
+		return l
+	}
+	if o.IngestionRate != 0 {
+		l.IngestionRate = o.IngestionRate
+	}
+	if o.IngestionBurstSize != 0 {
+		l.IngestionBurstSize = o.IngestionBurstSize
+	}
+	if o.IngestionBytesRate != 0 {
+		l.IngestionBytesRate = o.IngestionBytesRate
+	}
+	if o.IngestionBytesBurstSize != 0 {
+		l.IngestionBytesBurstSize = o.IngestionBytesBurstSize
+	}
+	if o.MaxSeries != 0 {
+		l.MaxSeries = o.MaxSeries
+	}
+	return l
+}
+
+// limitError is returned when a request exceeds the limits of its tenant.
+type limitError struct {
+	reason  string
+	message string
+}
+
+func (e *limitError) Error() string {
+	return e.message
+}
+
+// tokenBucket is a token bucket rate limiter, refilled at rate tokens per
+// second up to burst tokens.
+type tokenBucket struct {
+	rate      float64
+	burstSize int
+	burst     float64
+	tokens    float64
+	last      time.Time
+}
+
+func newTokenBucket(rate float64, burstSize int, now time.Time) *tokenBucket {
+	b := &tokenBucket{last: now}
+	b.update(rate, burstSize)
+	b.tokens = b.burst
+	return b
+}
+
+// allow takes n tokens from the bucket if there are enough of them.
+func (b *tokenBucket) allow(n float64, now time.Time) bool {
+	if !b.available(n, now) {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// available tells whether the bucket holds n tokens, without taking them.
+func (b *tokenBucket) available(n float64, now time.Time) bool {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+	return n <= b.tokens
+}
+
+// update changes the rate and burst of the bucket, keeping its tokens. The
+// burst defaults to one second worth of tokens.
+func (b *tokenBucket) update(rate float64, burstSize int) {
+	b.rate = rate
+	b.burstSize = burstSize
+	b.burst = float64(burstSize)
+	if b.burst <= 0 {
+		b.burst = rate
+	}
+	b.tokens = math.Min(b.tokens, b.burst)
+}
+
+// rateLimiter keeps the samples and bytes token buckets of every tenant.
+type rateLimiter struct {
+	mu      sync.Mutex
+	samples map[string]*tokenBucket
+	bytes   map[string]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		samples: make(map[string]*tokenBucket),
+		bytes:   make(map[string]*tokenBucket),
+	}
+}
+
+// allow checks whether a tenant can ingest a request of the given number of
+// samples and bytes, taking the tokens if it can. Tokens are only taken once
+// both limits allow the request, so rejected requests cost nothing.
+func (r *rateLimiter) allow(tenant string, limits tenantLimits, samples, bytes int, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var samplesBucket, bytesBucket *tokenBucket
+	if limits.IngestionRate > 0 {
+		samplesBucket = bucket(r.samples, tenant, limits.IngestionRate, limits.IngestionBurstSize, now)
+		if !samplesBucket.available(float64(samples), now) {
+			return &limitError{
+				reason:  reasonRateLimited,
+				message: fmt.Sprintf("ingestion rate limit (%g samples/s) exceeded for tenant %q while adding %d samples", limits.IngestionRate, tenant, samples),
+			}
+		}
+	}
+
+	if limits.IngestionBytesRate > 0 {
+		bytesBucket = bucket(r.bytes, tenant, limits.IngestionBytesRate, limits.IngestionBytesBurstSize, now)
+		if !bytesBucket.available(float64(bytes), now) {
+			return &limitError{
+				reason:  reasonBytesRateLimited,
+				message: fmt.Sprintf("ingestion rate limit (%g bytes/s) exceeded for tenant %q while adding %d bytes", limits.IngestionBytesRate, tenant, bytes),
+			}
+		}
+	}
+
+	if samplesBucket != nil {
+		samplesBucket.allow(float64(samples), now)
+	}
+	if bytesBucket != nil {
+		bytesBucket.allow(float64(bytes), now)
+	}
+	return nil
+}
+
+func bucket(buckets map[string]*tokenBucket, tenant string, rate float64, burstSize int, now time.Time) *tokenBucket {
+	b, ok := buckets[tenant]
+	if !ok {
+		b = newTokenBucket(rate, burstSize, now)
+		buckets[tenant] = b
+	} else if b.rate != rate || b.burstSize != burstSize {
+		b.update(rate, burstSize)
+	}
+	return b
+}
+
+// seriesTracker keeps the active series of every tenant, keyed by the hash of
+// their labels. Series not seen for a while are forgotten, and a tenant never
+// tracks more series than its limit.
+type seriesTracker struct {
+	mu      sync.Mutex
+	tenants map[string]map[uint64]time.Time
+}
+
+func newSeriesTracker() *seriesTracker {
+	return &seriesTracker{
+		tenants: make(map[string]map[uint64]time.Time),
+	}
+}
+
+// admit records the series of the request as active, removing from it the new
+// series that would exceed the limit. It returns the number of discarded
+// samples.
+func (t *seriesTracker) admit(tenant string, limit int, req *prompb.WriteRequest, now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	series, ok := t.tenants[tenant]
+	if !ok {
+		series = make(map[uint64]time.Time)
+		t.tenants[tenant] = series
+	}
+
+	discarded := 0
+	kept := req.Timeseries[:0]
+	for _, ts := range req.Timeseries {
+		h := hashLabels(ts.Labels)
+		if _, ok := series[h]; !ok && len(series) >= limit {
+			discarded += len(ts.Samples)
+			continue
+		}
+		series[h] = now
+		kept = append(kept, ts)
+	}
+	req.Timeseries = kept
+
+	activeSeries.WithLabelValues(tenant).Set(float64(len(series)))
+	return discarded
+}
+
+// purge forgets the series that have not been seen since the deadline.
+func (t *seriesTracker) purge(deadline time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for tenant, series := range t.tenants {
+		for h, seen := range series {
+			if seen.Before(deadline) {
+				delete(series, h)
+			}
+		}
+		if len(series) == 0 {
+			delete(t.tenants, tenant)
+			activeSeries.DeleteLabelValues(tenant)
+			continue
+		}
+		activeSeries.WithLabelValues(tenant).Set(float64(len(series)))
+	}
+}
+
+// run forgets periodically the series inactive for longer than the timeout.
+func (t *seriesTracker) run(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	for now := range ticker.C {
+		t.purge(now.Add(-timeout))
+	}
+}
+
+func hashLabels(labels []prompb.Label) uint64 {
+	h := fnv.New64a()
+	sep := []byte{0xff}
+	for _, l := range labels {
+		h.Write([]byte(l.Name))
+		h.Write(sep)
+		h.Write([]byte(l.Value))
+		h.Write(sep)
+	}
+	return h.Sum64()
+}
+
+var (
+	ingestionLimiter = newRateLimiter()
+	activeSeriesSet  = newSeriesTracker()
+)
+
+// applyLimits enforces the limits of the tenant on a request, which may be
+// left with fewer series than it had. The returned error describes the limit
+// that was hit, if any, and the request must be rejected as a whole when no
+// series are left in it.
+func applyLimits(tenant string, req *prompb.WriteRequest, size int) error {
+	limits := limitsFor(tenant)
+	now := time.Now()
+
+	samples := 0
+	for _, ts := range req.Timeseries {
+		samples += len(ts.Samples)
+	}
+
+	if err := ingestionLimiter.allow(tenant, limits, samples, size, now); err != nil {
+		discardedSamples.WithLabelValues(tenant, err.(*limitError).reason).Add(float64(samples))
+		req.Timeseries = nil
+		return err
+	}
+
+	if limits.MaxSeries > 0 {
+		if discarded := activeSeriesSet.admit(tenant, limits.MaxSeries, req, now); discarded > 0 {
+			discardedSamples.WithLabelValues(tenant, reasonSeriesLimit).Add(float64(discarded))
+			return &limitError{
+				reason:  reasonSeriesLimit,
+				message: fmt.Sprintf("per-tenant series limit of %d exceeded for tenant %q, %d samples discarded", limits.MaxSeries, tenant, discarded),
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newTokenBucket(10, 20, now)
+
+	assert.True(t, b.allow(20, now))
+	assert.False(t, b.allow(1, now))
+	assert.True(t, b.allow(5, now.Add(500*time.Millisecond)))
+	assert.False(t, b.allow(30, now.Add(time.Hour)), "burst caps the available tokens")
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := newRateLimiter()
+	limits := tenantLimits{IngestionRate: 100, IngestionBytesRate: 1000}
+
+	assert.Nil(t, r.allow("team-a", limits, 100, 10, now))
+	err := r.allow("team-a", limits, 1, 10, now)
+	assert.Equal(t, reasonRateLimited, err.(*limitError).reason)
+	assert.Nil(t, r.allow("team-b", limits, 1, 10, now), "tenants have their own buckets")
+
+	err = r.allow("team-c", limits, 1, 2000, now)
+	assert.Equal(t, reasonBytesRateLimited, err.(*limitError).reason)
+
+	// Requests rejected by the bytes limit don't use up the samples budget.
+	for i := 0; i < 3; i++ {
+		err = r.allow("team-d", limits, 60, 2000, now)
+		assert.Equal(t, reasonBytesRateLimited, err.(*limitError).reason)
+	}
+	assert.Equal(t, float64(100), r.samples["team-d"].tokens)
+	assert.Nil(t, r.allow("team-d", limits, 100, 10, now))
+}
+
+func TestSeriesTracker(t *testing.T) {
+	now := time.Unix(0, 0)
+	tracker := newSeriesTracker()
+
+	req := NewWriteRequest()
+	req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "bar"}},
+		Samples: []prompb.Sample{{Timestamp: 0, Value: 1}},
+	})
+
+	discarded := tracker.admit("team-a", 1, req, now)
+	assert.Equal(t, 1, discarded)
+	assert.Len(t, req.Timeseries, 1)
+	assert.Equal(t, "foo", req.Timeseries[0].Labels[0].Value)
+
+	req = NewWriteRequest()
+	assert.Equal(t, 0, tracker.admit("team-a", 1, req, now), "known series are always accepted")
+
+	tracker.purge(now.Add(time.Second))
+	req = &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "bar"}},
+		Samples: []prompb.Sample{{Timestamp: 0, Value: 1}},
+	}}}
+	assert.Equal(t, 0, tracker.admit("team-a", 1, req, now), "inactive series are forgotten")
+}
@@ -15,9 +15,10 @@
 package main
 
 import (
+	"context"
+	"os"
 	"time"
 
-	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/gin-gonic/contrib/ginrus"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -25,63 +26,117 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "consume":
+			if err := runConsume(os.Args[2:]); err != nil {
+				logrus.WithError(err).Fatal("couldn't consume")
+			}
+			return
+		case "tail":
+			if err := runTail(os.Args[2:]); err != nil {
+				logrus.WithError(err).Fatal("couldn't tail")
+			}
+			return
+		}
+	}
+
 	logrus.Info("creating kafka producer")
 
-	kafkaConfig := kafka.ConfigMap{
-		"bootstrap.servers":   kafkaBrokerList,
-		"compression.codec":   kafkaCompression,
-		"batch.num.messages":  kafkaBatchNumMessages,
-		"go.batch.producer":   true,  // Enable batch producer (for increased performance).
-		"go.delivery.reports": false, // per-message delivery reports to the Events() channel
+	if err := startSinks(); err != nil {
+		logrus.WithError(err).Fatal("couldn't create kafka producer")
 	}
 
-	if kafkaSslClientCertFile != "" && kafkaSslClientKeyFile != "" && kafkaSslCACertFile != "" {
-		if kafkaSecurityProtocol == "" {
-			kafkaSecurityProtocol = "ssl"
+	if forwardFilePath != "" {
+		var err error
+		if forwarders, err = loadForwarders(forwardFilePath); err != nil {
+			logrus.WithError(err).Fatal("couldn't load the remote write forwarders")
 		}
-
-		if kafkaSecurityProtocol != "ssl" && kafkaSecurityProtocol != "sasl_ssl" {
-			logrus.Fatal("invalid config: kafka security protocol is not ssl based but ssl config is provided")
+		for _, f := range forwarders {
+			if files := f.files(); len(files) > 0 {
+				registerReload("forwarder "+f.URL, files, f.reload)
+			}
+			go f.run(context.Background())
 		}
-
-		kafkaConfig["security.protocol"] = kafkaSecurityProtocol
-		kafkaConfig["ssl.ca.location"] = kafkaSslCACertFile              // CA certificate file for verifying the broker's certificate.
-		kafkaConfig["ssl.certificate.location"] = kafkaSslClientCertFile // Client's certificate
-		kafkaConfig["ssl.key.location"] = kafkaSslClientKeyFile          // Client's key
-		kafkaConfig["ssl.key.password"] = kafkaSslClientKeyPass          // Key password, if any.
 	}
 
-	if kafkaSaslMechanism != "" && kafkaSaslUsername != "" && kafkaSaslPassword != "" {
-		if kafkaSecurityProtocol != "sasl_ssl" && kafkaSecurityProtocol != "sasl_plaintext" {
-			logrus.Fatal("invalid config: kafka security protocol is not sasl based but sasl config is provided")
+	if federateFilePath != "" {
+		var err error
+		if scrapeTargets, err = loadScrapeTargets(federateFilePath); err != nil {
+			logrus.WithError(err).Fatal("couldn't load the scrape targets")
+		}
+		for _, t := range scrapeTargets {
+			if files := t.files(); len(files) > 0 {
+				registerReload("scrape target "+t.URL, files, t.reload)
+			}
+			go t.run(context.Background(), serializer)
 		}
+	}
 
-		kafkaConfig["security.protocol"] = kafkaSecurityProtocol
-		kafkaConfig["sasl.mechanism"] = kafkaSaslMechanism
-		kafkaConfig["sasl.username"] = kafkaSaslUsername
-		kafkaConfig["sasl.password"] = kafkaSaslPassword
+	if err := startGraphite(serializer); err != nil {
+		logrus.WithError(err).Fatal("couldn't start the graphite listeners")
 	}
 
-	producer, err := kafka.NewProducer(&kafkaConfig)
+	if remoteReadSamplesPerSeries > 0 {
+		remoteReadBuffer = newReadBuffer(remoteReadSamplesPerSeries, remoteReadMaxSeries)
+		if len(remoteReadSeedTopics) > 0 {
+			go func() {
+				if err := seedReadBuffer(remoteReadBuffer, remoteReadSeedTopics, remoteReadSeedLookback, remoteReadSeedTimeout); err != nil {
+					logrus.WithError(err).Error("couldn't seed the remote read buffer")
+				}
+			}()
+		}
+	}
 
-	if err != nil {
-		logrus.WithError(err).Fatal("couldn't create kafka producer")
+	if tenantOverridesFile != "" {
+		registerReload("tenant-overrides", []string{tenantOverridesFile}, func() error {
+			overrides, err := loadTenantOverrides(tenantOverridesFile)
+			if err != nil {
+				return err
+			}
+			setTenantOverrides(overrides)
+			return nil
+		})
+	}
+	if err := requestAuth.reload(); err != nil {
+		logrus.WithError(err).Fatal("couldn't load the credential files")
+	}
+	if files := requestAuth.files(); len(files) > 0 {
+		registerReload("auth", files, requestAuth.reload)
 	}
+	startReloader(configReloadInterval)
+
+	go activeSeriesSet.run(activeSeriesTimeout)
+	go deltas.run(activeSeriesTimeout)
 
 	r := gin.New()
 
 	r.Use(ginrus.Ginrus(logrus.StandardLogger(), time.RFC3339, true), gin.Recovery())
 
 	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
-	r.GET("/healthz", func(c *gin.Context) { c.JSON(200, gin.H{"status": "UP"}) })
-	if basicauth {
-		authorized := r.Group("/", gin.BasicAuth(gin.Accounts{
-			basicauthUsername: basicauthPassword,
-		}))
-		authorized.POST("/receive", receiveHandler(producer, serializer))
-	} else {
-		r.POST("/receive", receiveHandler(producer, serializer))
+	r.GET("/healthz", func(c *gin.Context) { c.JSON(200, gin.H{"status": "UP", "sinks": sinksHealth()}) })
+	r.GET("/ready", readyHandler)
+
+	var ingestion, admin gin.IRoutes = r, r
+	if requestAuth.enabled() {
+		ingestion = r.Group("/", requestAuth.middleware())
+		admin = r.Group("/", requestAuth.middleware())
+	}
+	if haDedup != nil {
+		admin.GET("/admin/ha-tracker", haTrackerHandler(haDedup))
+	}
+	admin.GET("/admin/config", configHandler)
+
+	ingestion.POST("/receive", receiveHandler(serializer))
+	ingestion.POST("/v1/metrics", otlpHandler(serializer))
+	ingestion.POST("/api/v2/write", influxHandler(serializer, false))
+	ingestion.POST("/write", influxHandler(serializer, true))
+	ingestion.POST("/push/*path", pushHandler(serializer))
+	ingestion.PUT("/push/*path", pushHandler(serializer))
+	ingestion.POST("/alerts", alertsHandler(alertsSerializer))
+	if remoteReadBuffer != nil {
+		ingestion.POST("/read", readHandler(remoteReadBuffer))
 	}
 
-	logrus.Fatal(r.Run())
+	logrus.Fatal(serve(r))
 }
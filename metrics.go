@@ -52,6 +52,186 @@ var (
 			Name: "objects_failed_total",
 			Help: "Count of all objects write failures to Kafka",
 		})
+	discardedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "discarded_samples_total",
+			Help: "Count of samples discarded because of the tenant limits",
+		}, []string{"tenant", "reason"})
+	activeSeries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "active_series",
+			Help: "Number of active series tracked per tenant",
+		}, []string{"tenant"})
+	dedupedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ha_deduped_samples_total",
+			Help: "Count of samples discarded because they were not sent by the elected HA replica",
+		}, []string{"tenant", "cluster"})
+	haElectedReplica = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ha_tracker_elected_replica",
+			Help: "Replica currently elected as leader of each HA cluster",
+		}, []string{"tenant", "cluster", "replica"})
+	haElectedReplicaChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ha_tracker_elected_replica_changes_total",
+			Help: "Count of elected replica changes per HA cluster",
+		}, []string{"tenant", "cluster"})
+	authFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "auth_failures_total",
+			Help: "Count of authentication and authorization failures",
+		}, []string{"reason"})
+	tlsCertificateExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tls_certificate_expiry_timestamp_seconds",
+			Help: "Expiry time of the certificates in use, the earliest one for CA bundles",
+		}, []string{"file"})
+	oauthBearerTokenExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kafka_oauthbearer_token_expiry_timestamp_seconds",
+			Help: "Expiry time of the kafka oauthbearer token in use by each kafka sink",
+		}, []string{"sink"})
+	oauthBearerRefreshesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kafka_oauthbearer_token_refreshes_total",
+			Help: "Count of kafka oauthbearer token refreshes of each kafka sink",
+		}, []string{"sink"})
+	oauthBearerRefreshFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kafka_oauthbearer_token_refresh_failures_total",
+			Help: "Count of failed kafka oauthbearer token refreshes of each kafka sink",
+		}, []string{"sink"})
+	sinkProduced = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kafka_sink_produced_total",
+			Help: "Count of messages produced to each kafka sink",
+		}, []string{"sink"})
+	sinkFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kafka_sink_failed_total",
+			Help: "Count of messages that couldn't be produced or delivered to each kafka sink",
+		}, []string{"sink"})
+	sinkUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kafka_sink_up",
+			Help: "Whether the brokers of each kafka sink are reachable",
+		}, []string{"sink"})
+	failoverActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kafka_sink_failover_active",
+			Help: "Whether each kafka sink has failed over to its standby",
+		}, []string{"sink"})
+	failoverSwitches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kafka_sink_failover_switches_total",
+			Help: "Count of switches between each kafka sink and its standby",
+		}, []string{"sink"})
+	failoverRetried = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kafka_sink_failover_retried_total",
+			Help: "Count of messages that couldn't be delivered to each kafka sink and were retried on its standby",
+		}, []string{"sink"})
+	circuitBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kafka_circuit_breaker_state",
+			Help: "State of the circuit breaker of each topic of each kafka sink: 0 closed, 1 open, 2 half-open",
+		}, []string{"sink", "topic"})
+	circuitBreakerTransitions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kafka_circuit_breaker_transitions_total",
+			Help: "Count of circuit breaker transitions per topic and kafka sink, by new state",
+		}, []string{"sink", "topic", "state"})
+	forwardRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "remote_write_forward_requests_total",
+			Help: "Count of write requests forwarded to each remote write endpoint, by result",
+		}, []string{"url", "result"})
+	forwardSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "remote_write_forward_samples_total",
+			Help: "Count of samples forwarded to each remote write endpoint",
+		}, []string{"url"})
+	forwardRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "remote_write_forward_retries_total",
+			Help: "Count of retried write requests per remote write endpoint",
+		}, []string{"url"})
+	forwardQueueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "remote_write_forward_queue_length",
+			Help: "Number of write requests waiting to be forwarded to each remote write endpoint",
+		}, []string{"url"})
+	federateUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "federate_target_up",
+			Help: "Whether the last scrape of each target was successful",
+		}, []string{"url"})
+	federateScrapeDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "federate_target_scrape_duration_seconds",
+			Help: "Duration of the last scrape of each target",
+		}, []string{"url"})
+	federateScrapeSamples = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "federate_target_scrape_samples",
+			Help: "Number of samples of the last successful scrape of each target",
+		}, []string{"url"})
+	federateScrapes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "federate_scrapes_total",
+			Help: "Count of scrapes of each target, by result",
+		}, []string{"url", "result"})
+	graphiteSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_samples_received_total",
+			Help: "Count of graphite samples received, by protocol",
+		}, []string{"protocol"})
+	graphiteParseErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_parse_errors_total",
+			Help: "Count of graphite lines or messages that couldn't be parsed, by protocol and reason",
+		}, []string{"protocol", "reason"})
+	graphiteConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "graphite_connections",
+			Help: "Number of open graphite connections, by protocol",
+		}, []string{"protocol"})
+	graphiteRejectedConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_connections_rejected_total",
+			Help: "Count of graphite connections closed because of the connection limit, by protocol",
+		}, []string{"protocol"})
+	alertsReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alerts_received_total",
+			Help: "Count of alerts received from the Alertmanager and produced, by status",
+		}, []string{"status"})
+	remoteReadBufferSeries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "remote_read_buffer_series",
+			Help: "Number of series held in the remote read buffer",
+		})
+	remoteReadRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "remote_read_requests_total",
+			Help: "Count of remote read requests answered, by response type",
+		}, []string{"response_type"})
+	remoteReadSeededSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "remote_read_seeded_samples_total",
+			Help: "Count of samples read from kafka into the remote read buffer",
+		})
+	configReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "config_reloads_total",
+			Help: "Count of configuration reloads",
+		}, []string{"config", "result"})
+	configLastReloadSuccessful = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful",
+		}, []string{"config"})
 )
 
 func init() {
@@ -62,4 +242,40 @@ func init() {
 	prometheus.MustRegister(objectsFiltered)
 	prometheus.MustRegister(objectsFailed)
 	prometheus.MustRegister(objectsWritten)
+	prometheus.MustRegister(discardedSamples)
+	prometheus.MustRegister(activeSeries)
+	prometheus.MustRegister(dedupedSamples)
+	prometheus.MustRegister(haElectedReplica)
+	prometheus.MustRegister(haElectedReplicaChanges)
+	prometheus.MustRegister(authFailures)
+	prometheus.MustRegister(tlsCertificateExpiry)
+	prometheus.MustRegister(oauthBearerTokenExpiry)
+	prometheus.MustRegister(oauthBearerRefreshesTotal)
+	prometheus.MustRegister(oauthBearerRefreshFailures)
+	prometheus.MustRegister(sinkProduced)
+	prometheus.MustRegister(sinkFailed)
+	prometheus.MustRegister(sinkUp)
+	prometheus.MustRegister(failoverActive)
+	prometheus.MustRegister(failoverSwitches)
+	prometheus.MustRegister(failoverRetried)
+	prometheus.MustRegister(circuitBreakerState)
+	prometheus.MustRegister(circuitBreakerTransitions)
+	prometheus.MustRegister(forwardRequests)
+	prometheus.MustRegister(forwardSamples)
+	prometheus.MustRegister(forwardRetries)
+	prometheus.MustRegister(forwardQueueLength)
+	prometheus.MustRegister(federateUp)
+	prometheus.MustRegister(federateScrapeDuration)
+	prometheus.MustRegister(federateScrapeSamples)
+	prometheus.MustRegister(federateScrapes)
+	prometheus.MustRegister(graphiteSamples)
+	prometheus.MustRegister(graphiteParseErrors)
+	prometheus.MustRegister(graphiteConnections)
+	prometheus.MustRegister(graphiteRejectedConnections)
+	prometheus.MustRegister(alertsReceived)
+	prometheus.MustRegister(remoteReadBufferSeries)
+	prometheus.MustRegister(remoteReadRequests)
+	prometheus.MustRegister(remoteReadSeededSamples)
+	prometheus.MustRegister(configReloadsTotal)
+	prometheus.MustRegister(configLastReloadSuccessful)
 }
@@ -0,0 +1,212 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+)
+
+const oauthBearerCommandTimeout = 30 * time.Second
+
+// oauthBearerConfig holds the OAUTHBEARER settings of a sink: either
+// librdkafka's oidc method, or a token file or command read by the adapter.
+type oauthBearerConfig struct {
+	Method           string            `yaml:"method"`
+	ClientID         string            `yaml:"client_id"`
+	ClientSecretFile string            `yaml:"client_secret_file"`
+	TokenEndpointURL string            `yaml:"token_endpoint_url"`
+	Scope            string            `yaml:"scope"`
+	Extensions       map[string]string `yaml:"extensions"`
+	TokenFile        string            `yaml:"token_file"`
+	TokenCommand     string            `yaml:"token_command"`
+	TokenLifetime    time.Duration     `yaml:"token_lifetime"`
+	Principal        string            `yaml:"principal"`
+
+	clientSecret *secret
+}
+
+// envOAuthBearerConfig returns the OAUTHBEARER settings of the environment.
+func envOAuthBearerConfig() *oauthBearerConfig {
+	return &oauthBearerConfig{
+		Method:           kafkaOAuthBearerMethod,
+		ClientID:         kafkaOAuthBearerClientID,
+		TokenEndpointURL: kafkaOAuthBearerTokenEndpointURL,
+		Scope:            kafkaOAuthBearerScope,
+		Extensions:       kafkaOAuthBearerExtensions,
+		TokenFile:        kafkaOAuthBearerTokenFile,
+		TokenCommand:     kafkaOAuthBearerTokenCommand,
+		TokenLifetime:    kafkaOAuthBearerTokenLifetime,
+		Principal:        kafkaOAuthBearerPrincipal,
+		clientSecret:     kafkaOAuthBearerClientSecret,
+	}
+}
+
+// oauthBearerTokenSetter is implemented by the kafka clients accepting
+// OAUTHBEARER tokens.
+type oauthBearerTokenSetter interface {
+	SetOAuthBearerToken(kafka.OAuthBearerToken) error
+	SetOAuthBearerTokenFailure(string) error
+}
+
+// oauthBearerRefresher handles the OAuthBearerTokenRefresh events of a kafka
+// client. Tokens are fetched in the background, so a slow token command
+// doesn't hold up the event loop of the client, and are never set once the
+// client is closed.
+type oauthBearerRefresher struct {
+	sink   string
+	config *oauthBearerConfig
+	client oauthBearerTokenSetter
+
+	mu         sync.Mutex
+	refreshing bool
+	closed     bool
+}
+
+func newOAuthBearerRefresher(sink string, config *oauthBearerConfig, client oauthBearerTokenSetter) *oauthBearerRefresher {
+	return &oauthBearerRefresher{sink: sink, config: config, client: client}
+}
+
+// refresh fetches a new token from the configured file or command, unless a
+// refresh is already running.
+func (r *oauthBearerRefresher) refresh() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refreshing || r.closed {
+		return
+	}
+	r.refreshing = true
+
+	go func() {
+		token, err := fetchOAuthBearerToken(r.config, time.Now())
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.refreshing = false
+		if !r.closed {
+			r.set(token, err)
+		}
+	}()
+}
+
+// close stops setting tokens, it must be called before closing the client.
+func (r *oauthBearerRefresher) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+}
+
+func (r *oauthBearerRefresher) set(token kafka.OAuthBearerToken, err error) {
+	oauthBearerRefreshesTotal.WithLabelValues(r.sink).Inc()
+
+	if err != nil {
+		oauthBearerRefreshFailures.WithLabelValues(r.sink).Inc()
+		logrus.WithError(err).WithField("sink", r.sink).Error("couldn't refresh the kafka oauthbearer token")
+		r.client.SetOAuthBearerTokenFailure(err.Error())
+		return
+	}
+
+	if err := r.client.SetOAuthBearerToken(token); err != nil {
+		oauthBearerRefreshFailures.WithLabelValues(r.sink).Inc()
+		logrus.WithError(err).WithField("sink", r.sink).Error("couldn't set the kafka oauthbearer token")
+		r.client.SetOAuthBearerTokenFailure(err.Error())
+		return
+	}
+
+	oauthBearerTokenExpiry.WithLabelValues(r.sink).Set(float64(token.Expiration.Unix()))
+	logrus.WithFields(logrus.Fields{"sink": r.sink, "expiration": token.Expiration}).Debug("kafka oauthbearer token refreshed")
+}
+
+func fetchOAuthBearerToken(config *oauthBearerConfig, now time.Time) (kafka.OAuthBearerToken, error) {
+	if config == nil {
+		config = &oauthBearerConfig{}
+	}
+
+	var value []byte
+	var err error
+	switch {
+	case config.TokenFile != "":
+		value, err = ioutil.ReadFile(config.TokenFile)
+	case config.TokenCommand != "":
+		value, err = runOAuthBearerTokenCommand(config.TokenCommand)
+	default:
+		err = errors.New("no oauthbearer token file or command configured")
+	}
+	if err != nil {
+		return kafka.OAuthBearerToken{}, err
+	}
+
+	lifetime := config.TokenLifetime
+	if lifetime <= 0 {
+		lifetime = time.Hour
+	}
+	token := kafka.OAuthBearerToken{
+		TokenValue: strings.TrimSpace(string(value)),
+		Expiration: now.Add(lifetime),
+		Principal:  config.Principal,
+		Extensions: config.Extensions,
+	}
+	if token.TokenValue == "" {
+		return kafka.OAuthBearerToken{}, errors.New("empty oauthbearer token")
+	}
+
+	// JWTs carry their own expiry and subject, which take precedence over the
+	// configured ones. The token is not validated, the brokers do it.
+	if parts := strings.Split(token.TokenValue, "."); len(parts) == 3 {
+		var claims struct {
+			Exp float64 `json:"exp"`
+			Sub string  `json:"sub"`
+		}
+		if err := decodeSegment(parts[1], &claims); err == nil {
+			if claims.Exp > 0 {
+				token.Expiration = time.Unix(int64(claims.Exp), 0)
+			}
+			if claims.Sub != "" && token.Principal == "" {
+				token.Principal = claims.Sub
+			}
+		}
+	}
+	if token.Principal == "" {
+		return kafka.OAuthBearerToken{}, errors.New("no principal for the oauthbearer token, set KAFKA_SASL_OAUTHBEARER_PRINCIPAL or the principal of the sink")
+	}
+	if !token.Expiration.After(now) {
+		return kafka.OAuthBearerToken{}, fmt.Errorf("oauthbearer token expired at %s", token.Expiration)
+	}
+	return token, nil
+}
+
+func runOAuthBearerTokenCommand(command string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), oauthBearerCommandTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("oauthbearer token command failed: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchOAuthBearerToken(t *testing.T) {
+	now := time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)
+	file := filepath.Join(t.TempDir(), "token")
+	jwt := func(payload string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".signature"
+	}
+
+	// Opaque tokens from a file use the configured lifetime and principal.
+	assert.Nil(t, ioutil.WriteFile(file, []byte("opaque-token\n"), 0600))
+	config := &oauthBearerConfig{TokenFile: file, TokenLifetime: 10 * time.Minute, Principal: "adapter", Extensions: map[string]string{"logicalCluster": "lkc-1"}}
+	token, err := fetchOAuthBearerToken(config, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "opaque-token", token.TokenValue)
+	assert.Equal(t, now.Add(10*time.Minute), token.Expiration)
+	assert.Equal(t, "adapter", token.Principal)
+	assert.Equal(t, map[string]string{"logicalCluster": "lkc-1"}, token.Extensions)
+
+	// JWTs use their own expiry, and their subject when there's no principal.
+	value := jwt(`{"exp":1664622000,"sub":"svc-adapter"}`)
+	assert.Nil(t, ioutil.WriteFile(file, []byte(value), 0600))
+	token, err = fetchOAuthBearerToken(&oauthBearerConfig{TokenFile: file}, now)
+	assert.Nil(t, err)
+	assert.Equal(t, value, token.TokenValue)
+	assert.Equal(t, time.Unix(1664622000, 0), token.Expiration)
+	assert.Equal(t, "svc-adapter", token.Principal)
+	token, err = fetchOAuthBearerToken(config, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "adapter", token.Principal)
+
+	// The file takes precedence over the command.
+	token, err = fetchOAuthBearerToken(&oauthBearerConfig{TokenFile: file, TokenCommand: "echo other"}, now)
+	assert.Nil(t, err)
+	assert.Equal(t, value, token.TokenValue)
+
+	token, err = fetchOAuthBearerToken(&oauthBearerConfig{TokenCommand: "printf '%s\\n' command-token", Principal: "adapter"}, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "command-token", token.TokenValue)
+	assert.Equal(t, now.Add(time.Hour), token.Expiration, "the lifetime defaults to an hour")
+
+	for name, config := range map[string]*oauthBearerConfig{
+		"no source":      {},
+		"missing file":   {TokenFile: filepath.Join(t.TempDir(), "missing")},
+		"failed command": {TokenCommand: "echo broken >&2; exit 1", Principal: "adapter"},
+		"empty token":    {TokenCommand: "true", Principal: "adapter"},
+		"no principal":   {TokenCommand: "echo opaque-token"},
+		"expired token":  {TokenCommand: "echo " + jwt(`{"exp":1664617200,"sub":"svc-adapter"}`)},
+	} {
+		_, err := fetchOAuthBearerToken(config, now)
+		assert.NotNil(t, err, name)
+	}
+	_, err = fetchOAuthBearerToken(nil, now)
+	assert.NotNil(t, err)
+}
+
+type fakeTokenSetter struct {
+	tokens   chan kafka.OAuthBearerToken
+	failures chan string
+}
+
+func (f *fakeTokenSetter) SetOAuthBearerToken(token kafka.OAuthBearerToken) error {
+	f.tokens <- token
+	return nil
+}
+
+func (f *fakeTokenSetter) SetOAuthBearerTokenFailure(reason string) error {
+	f.failures <- reason
+	return nil
+}
+
+func TestOAuthBearerRefresher(t *testing.T) {
+	client := &fakeTokenSetter{tokens: make(chan kafka.OAuthBearerToken, 1), failures: make(chan string, 1)}
+	r := newOAuthBearerRefresher("compliance", &oauthBearerConfig{TokenCommand: "echo command-token", TokenLifetime: time.Hour, Principal: "adapter"}, client)
+
+	r.refresh()
+	select {
+	case token := <-client.tokens:
+		assert.Equal(t, "command-token", token.TokenValue)
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(oauthBearerTokenExpiry.WithLabelValues("compliance")) == float64(token.Expiration.Unix())
+		}, 5*time.Second, 10*time.Millisecond, "metrics are labelled with the sink")
+	case <-time.After(5 * time.Second):
+		t.Fatal("token not set")
+	}
+
+	failures := testutil.ToFloat64(oauthBearerRefreshFailures.WithLabelValues("eu"))
+	r = newOAuthBearerRefresher("eu", &oauthBearerConfig{TokenCommand: "exit 1"}, client)
+	r.refresh()
+	select {
+	case reason := <-client.failures:
+		assert.Contains(t, reason, "oauthbearer token command failed")
+		assert.Equal(t, failures+1, testutil.ToFloat64(oauthBearerRefreshFailures.WithLabelValues("eu")))
+	case <-time.After(5 * time.Second):
+		t.Fatal("failure not set")
+	}
+
+	// Tokens fetched after the client is closed are dropped.
+	r = newOAuthBearerRefresher("compliance", &oauthBearerConfig{TokenCommand: "sleep 0.2; echo late-token", Principal: "adapter"}, client)
+	r.refresh()
+	r.close()
+	r.refresh()
+	select {
+	case token := <-client.tokens:
+		t.Fatalf("token %q set after close", token.TokenValue)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
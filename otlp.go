@@ -0,0 +1,417 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpHandler accepts OTLP/HTTP metric exports, in protobuf or JSON, and
+// ingests them as remote write requests.
+func otlpHandler(serializer Serializer) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		httpRequestsTotal.Add(float64(1))
+
+		meta, ok := ingestMeta(c)
+		if !ok {
+			return
+		}
+
+		var body io.Reader = c.Request.Body
+		if c.GetHeader("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				c.AbortWithStatus(http.StatusBadRequest)
+				logrus.WithError(err).Error("couldn't decompress body")
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+		buf, err := ioutil.ReadAll(body)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			logrus.WithError(err).Error("couldn't read body")
+			return
+		}
+
+		// MetricsData has the same wire format as the export request of the
+		// collector service, which saves depending on the grpc packages.
+		var data metricspb.MetricsData
+		isJSON := c.ContentType() == "application/json"
+		if isJSON {
+			err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(buf, &data)
+		} else {
+			err = proto.Unmarshal(buf, &data)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			c.Abort()
+			logrus.WithError(err).Error("couldn't unmarshal body")
+			return
+		}
+
+		req := otlpToWriteRequest(&data, meta.tenant, time.Now())
+		status, err := ingest(serializer, req, meta, requestIdentity(c), len(buf))
+		if err != nil {
+			respondIngest(c, status, err)
+			return
+		}
+		if isJSON {
+			c.Data(status, "application/json", []byte("{}"))
+		} else {
+			c.Data(status, "application/x-protobuf", nil)
+		}
+	}
+}
+
+// otlpToWriteRequest translates OTLP metrics into series following the
+// naming conventions of Prometheus. Delta sums and histograms are
+// accumulated into cumulative ones.
+func otlpToWriteRequest(data *metricspb.MetricsData, tenant string, now time.Time) *prompb.WriteRequest {
+	c := &otlpConverter{tenant: tenant, now: now, series: map[uint64]int{}, req: &prompb.WriteRequest{}}
+	for _, rm := range data.ResourceMetrics {
+		var resource []*commonpb.KeyValue
+		if rm.Resource != nil {
+			resource = rm.Resource.Attributes
+		}
+		c.resource = resourceLabels(resource)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				c.convert(m)
+			}
+		}
+	}
+	return c.req
+}
+
+type otlpConverter struct {
+	tenant   string
+	now      time.Time
+	resource map[string]string
+	series   map[uint64]int
+	req      *prompb.WriteRequest
+}
+
+func (c *otlpConverter) convert(m *metricspb.Metric) {
+	name := sanitizeMetricName(m.Name)
+	switch data := m.Data.(type) {
+	case *metricspb.Metric_Gauge:
+		for _, p := range data.Gauge.DataPoints {
+			c.add(name, p.Attributes, nil, numberValue(p), p.TimeUnixNano, p.Flags, false)
+		}
+	case *metricspb.Metric_Sum:
+		if data.Sum.IsMonotonic && !strings.HasSuffix(name, "_total") {
+			name += "_total"
+		}
+		delta := data.Sum.AggregationTemporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+		for _, p := range data.Sum.DataPoints {
+			c.add(name, p.Attributes, nil, numberValue(p), p.TimeUnixNano, p.Flags, delta)
+		}
+	case *metricspb.Metric_Histogram:
+		delta := data.Histogram.AggregationTemporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+		for _, p := range data.Histogram.DataPoints {
+			var cumulative uint64
+			for i, bound := range p.ExplicitBounds {
+				if i < len(p.BucketCounts) {
+					cumulative += p.BucketCounts[i]
+				}
+				c.add(name+"_bucket", p.Attributes, []string{"le", formatFloat(bound)}, float64(cumulative), p.TimeUnixNano, p.Flags, delta)
+			}
+			c.add(name+"_bucket", p.Attributes, []string{"le", "+Inf"}, float64(p.Count), p.TimeUnixNano, p.Flags, delta)
+			if p.Sum != nil {
+				c.add(name+"_sum", p.Attributes, nil, *p.Sum, p.TimeUnixNano, p.Flags, delta)
+			}
+			c.add(name+"_count", p.Attributes, nil, float64(p.Count), p.TimeUnixNano, p.Flags, delta)
+		}
+	case *metricspb.Metric_ExponentialHistogram:
+		delta := data.ExponentialHistogram.AggregationTemporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+		for _, p := range data.ExponentialHistogram.DataPoints {
+			for _, b := range exponentialBuckets(p) {
+				c.add(name+"_bucket", p.Attributes, []string{"le", formatFloat(b.le)}, float64(b.count), p.TimeUnixNano, p.Flags, delta)
+			}
+			c.add(name+"_bucket", p.Attributes, []string{"le", "+Inf"}, float64(p.Count), p.TimeUnixNano, p.Flags, delta)
+			if p.Sum != nil {
+				c.add(name+"_sum", p.Attributes, nil, *p.Sum, p.TimeUnixNano, p.Flags, delta)
+			}
+			c.add(name+"_count", p.Attributes, nil, float64(p.Count), p.TimeUnixNano, p.Flags, delta)
+		}
+	case *metricspb.Metric_Summary:
+		for _, p := range data.Summary.DataPoints {
+			for _, q := range p.QuantileValues {
+				c.add(name, p.Attributes, []string{"quantile", formatFloat(q.Quantile)}, q.Value, p.TimeUnixNano, p.Flags, false)
+			}
+			c.add(name+"_sum", p.Attributes, nil, p.Sum, p.TimeUnixNano, p.Flags, false)
+			c.add(name+"_count", p.Attributes, nil, float64(p.Count), p.TimeUnixNano, p.Flags, false)
+		}
+	}
+}
+
+// add appends a sample to its series, extra holds the label the series
+// needs besides the attributes, like le or quantile. Points without
+// timestamp take the time of the request.
+func (c *otlpConverter) add(name string, attributes []*commonpb.KeyValue, extra []string, v float64, ts uint64, flags uint32, delta bool) {
+	labels := make(map[string]string, len(c.resource)+len(attributes)+2)
+	for k, v := range c.resource {
+		labels[k] = v
+	}
+	for _, a := range attributes {
+		labels[sanitizeLabelName(a.Key)] = attributeValue(a.Value)
+	}
+	if len(extra) == 2 {
+		labels[extra[0]] = extra[1]
+	}
+	labels["__name__"] = name
+
+	series := make([]prompb.Label, 0, len(labels))
+	for k, v := range labels {
+		series = append(series, prompb.Label{Name: k, Value: v})
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Name < series[j].Name })
+
+	h := hashLabels(series)
+	if ts == 0 {
+		ts = uint64(c.now.UnixNano())
+	}
+	if flags&uint32(metricspb.DataPointFlags_FLAG_NO_RECORDED_VALUE) != 0 {
+		v = math.Float64frombits(value.StaleNaN)
+	} else if delta {
+		v = deltas.accumulate(c.tenant, h, v, ts, c.now)
+	}
+
+	sample := prompb.Sample{Value: v, Timestamp: int64(ts / uint64(time.Millisecond))}
+	if i, ok := c.series[h]; ok {
+		c.req.Timeseries[i].Samples = append(c.req.Timeseries[i].Samples, sample)
+		return
+	}
+	c.series[h] = len(c.req.Timeseries)
+	c.req.Timeseries = append(c.req.Timeseries, prompb.TimeSeries{Labels: series, Samples: []prompb.Sample{sample}})
+}
+
+func numberValue(p *metricspb.NumberDataPoint) float64 {
+	switch v := p.Value.(type) {
+	case *metricspb.NumberDataPoint_AsDouble:
+		return v.AsDouble
+	case *metricspb.NumberDataPoint_AsInt:
+		return float64(v.AsInt)
+	}
+	return 0
+}
+
+type exponentialBucket struct {
+	le    float64
+	count uint64
+}
+
+// exponentialBuckets returns the cumulative buckets of an exponential
+// histogram as classic ones. The bucket of index i holds the values in
+// (base^i, base^(i+1)], base being 2^(2^-scale).
+func exponentialBuckets(p *metricspb.ExponentialHistogramDataPoint) []exponentialBucket {
+	bound := func(index int32) float64 {
+		return math.Exp2(float64(index) * math.Exp2(-float64(p.Scale)))
+	}
+
+	var buckets []exponentialBucket
+	var cumulative uint64
+	if n := p.Negative; n != nil {
+		for i := len(n.BucketCounts) - 1; i >= 0; i-- {
+			cumulative += n.BucketCounts[i]
+			buckets = append(buckets, exponentialBucket{le: -bound(n.Offset + int32(i)), count: cumulative})
+		}
+	}
+	cumulative += p.ZeroCount
+	buckets = append(buckets, exponentialBucket{le: 0, count: cumulative})
+	if pos := p.Positive; pos != nil {
+		for i, count := range pos.BucketCounts {
+			cumulative += count
+			buckets = append(buckets, exponentialBucket{le: bound(pos.Offset + int32(i) + 1), count: cumulative})
+		}
+	}
+	return buckets
+}
+
+// resourceLabels maps the resource attributes to labels. The service name,
+// prefixed by its namespace, becomes the job and the service instance the
+// instance, as Prometheus does.
+func resourceLabels(attributes []*commonpb.KeyValue) map[string]string {
+	labels := make(map[string]string, len(attributes))
+	var namespace, service string
+	for _, a := range attributes {
+		v := attributeValue(a.Value)
+		switch a.Key {
+		case "service.name":
+			service = v
+		case "service.namespace":
+			namespace = v
+		case "service.instance.id":
+			labels["instance"] = v
+		}
+		labels[sanitizeLabelName(a.Key)] = v
+	}
+	if service != "" {
+		if namespace != "" {
+			service = namespace + "/" + service
+		}
+		labels["job"] = service
+	}
+	return labels
+}
+
+func attributeValue(v *commonpb.AnyValue) string {
+	if v == nil {
+		return ""
+	}
+	switch v := v.Value.(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return formatFloat(v.DoubleValue)
+	case *commonpb.AnyValue_BytesValue:
+		return fmt.Sprintf("%x", v.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]string, 0, len(v.ArrayValue.Values))
+		for _, e := range v.ArrayValue.Values {
+			values = append(values, strconv.Quote(attributeValue(e)))
+		}
+		return "[" + strings.Join(values, ",") + "]"
+	case *commonpb.AnyValue_KvlistValue:
+		values := make([]string, 0, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			values = append(values, strconv.Quote(kv.Key)+":"+strconv.Quote(attributeValue(kv.Value)))
+		}
+		return "{" + strings.Join(values, ",") + "}"
+	}
+	return ""
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sanitizeMetricName replaces the characters not allowed in metric names by
+// underscores.
+func sanitizeMetricName(name string) string {
+	return sanitizeName(name, true)
+}
+
+// sanitizeLabelName replaces the characters not allowed in label names by
+// underscores, names starting with a digit are prefixed by key_.
+func sanitizeLabelName(name string) string {
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "key_" + name
+	}
+	return sanitizeName(name, false)
+}
+
+func sanitizeName(name string, colons bool) string {
+	b := []byte(name)
+	for i, ch := range b {
+		valid := ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') ||
+			(ch >= '0' && ch <= '9' && i > 0) || (ch == ':' && colons)
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// seriesKey identifies a series of a tenant.
+type seriesKey struct {
+	tenant string
+	series uint64
+}
+
+type deltaSeries struct {
+	value float64
+	// end is the time of the last point summed, in nanoseconds.
+	end      uint64
+	lastSeen time.Time
+}
+
+// deltaAccumulator turns the points of delta series into cumulative ones,
+// summing them per series. Points not newer than the last one summed are
+// resends, of a request that was rejected or failed, and aren't summed
+// again. Series not seen for a while are forgotten, so they start from zero
+// again.
+type deltaAccumulator struct {
+	mu     sync.Mutex
+	series map[seriesKey]*deltaSeries
+}
+
+var deltas = &deltaAccumulator{series: map[seriesKey]*deltaSeries{}}
+
+// accumulate sums the delta v of a point ending at ts to its series,
+// returning the cumulative value of the series.
+func (a *deltaAccumulator) accumulate(tenant string, series uint64, v float64, ts uint64, now time.Time) float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := seriesKey{tenant, series}
+	s, ok := a.series[key]
+	if !ok {
+		s = &deltaSeries{}
+		a.series[key] = s
+	}
+	if !ok || ts > s.end {
+		s.value += v
+		s.end = ts
+	}
+	s.lastSeen = now
+	return s.value
+}
+
+// purge forgets the series that have not been seen since the deadline.
+func (a *deltaAccumulator) purge(deadline time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for key, s := range a.series {
+		if s.lastSeen.Before(deadline) {
+			delete(a.series, key)
+		}
+	}
+}
+
+// run forgets periodically the series inactive for longer than the timeout.
+func (a *deltaAccumulator) run(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	for now := range ticker.C {
+		a.purge(now.Add(-timeout))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const otlpTestPayload = `{
+  "resourceMetrics": [{
+    "resource": {"attributes": [
+      {"key": "service.name", "value": {"stringValue": "checkout"}},
+      {"key": "service.namespace", "value": {"stringValue": "shop"}},
+      {"key": "service.instance.id", "value": {"stringValue": "pod-1"}}
+    ]},
+    "scopeMetrics": [{"metrics": [
+      {"name": "queue.size", "gauge": {"dataPoints": [
+        {"timeUnixNano": "1600000000000000000", "asInt": "3", "attributes": [{"key": "queue", "value": {"stringValue": "orders"}}]}
+      ]}},
+      {"name": "http.requests", "sum": {"isMonotonic": true, "aggregationTemporality": "AGGREGATION_TEMPORALITY_DELTA", "dataPoints": [
+        {"timeUnixNano": "1600000000000000000", "asDouble": 5}
+      ]}},
+      {"name": "latency", "histogram": {"aggregationTemporality": "AGGREGATION_TEMPORALITY_CUMULATIVE", "dataPoints": [
+        {"timeUnixNano": "1600000000000000000", "count": "6", "sum": 12.5, "explicitBounds": [1, 5], "bucketCounts": ["1", "2", "3"]}
+      ]}},
+      {"name": "size", "exponentialHistogram": {"aggregationTemporality": "AGGREGATION_TEMPORALITY_CUMULATIVE", "dataPoints": [
+        {"timeUnixNano": "1600000000000000000", "count": "4", "scale": 0, "zeroCount": "1",
+         "positive": {"offset": 1, "bucketCounts": ["2", "1"]}}
+      ]}},
+      {"name": "rpc.duration", "summary": {"dataPoints": [
+        {"timeUnixNano": "1600000000000000000", "count": "10", "sum": 20, "quantileValues": [{"quantile": 0.5, "value": 1.5}]}
+      ]}}
+    ]}]
+  }]
+}`
+
+func TestOTLPToWriteRequest(t *testing.T) {
+	var data metricspb.MetricsData
+	assert.Nil(t, protojson.Unmarshal([]byte(otlpTestPayload), &data))
+
+	values := func(req *prompb.WriteRequest) map[string]float64 {
+		result := map[string]float64{}
+		for _, ts := range req.Timeseries {
+			var key string
+			for _, l := range ts.Labels {
+				switch l.Name {
+				case "service_name", "service_namespace", "service_instance_id":
+					continue
+				}
+				key += l.Name + "=" + l.Value + ","
+			}
+			assert.Equal(t, int64(1600000000000), ts.Samples[0].Timestamp)
+			result[key] = ts.Samples[0].Value
+		}
+		return result
+	}
+
+	now := time.Now()
+	assert.Equal(t, map[string]float64{
+		"__name__=queue_size,instance=pod-1,job=shop/checkout,queue=orders,":   3,
+		"__name__=http_requests_total,instance=pod-1,job=shop/checkout,":       5,
+		"__name__=latency_bucket,instance=pod-1,job=shop/checkout,le=1,":       1,
+		"__name__=latency_bucket,instance=pod-1,job=shop/checkout,le=5,":       3,
+		"__name__=latency_bucket,instance=pod-1,job=shop/checkout,le=+Inf,":    6,
+		"__name__=latency_sum,instance=pod-1,job=shop/checkout,":               12.5,
+		"__name__=latency_count,instance=pod-1,job=shop/checkout,":             6,
+		"__name__=size_bucket,instance=pod-1,job=shop/checkout,le=0,":          1,
+		"__name__=size_bucket,instance=pod-1,job=shop/checkout,le=4,":          3,
+		"__name__=size_bucket,instance=pod-1,job=shop/checkout,le=8,":          4,
+		"__name__=size_bucket,instance=pod-1,job=shop/checkout,le=+Inf,":       4,
+		"__name__=size_count,instance=pod-1,job=shop/checkout,":                4,
+		"__name__=rpc_duration,instance=pod-1,job=shop/checkout,quantile=0.5,": 1.5,
+		"__name__=rpc_duration_sum,instance=pod-1,job=shop/checkout,":          20,
+		"__name__=rpc_duration_count,instance=pod-1,job=shop/checkout,":        10,
+	}, values(otlpToWriteRequest(&data, "tenant-otlp", now)))
+
+	// Delta points are accumulated per tenant, and resent points aren't
+	// summed twice.
+	assert.Equal(t, float64(5), values(otlpToWriteRequest(&data, "tenant-otlp", now))["__name__=http_requests_total,instance=pod-1,job=shop/checkout,"])
+	assert.Equal(t, float64(5), values(otlpToWriteRequest(&data, "other-tenant", now))["__name__=http_requests_total,instance=pod-1,job=shop/checkout,"])
+
+	deltas.purge(now.Add(time.Second))
+	assert.Equal(t, float64(5), values(otlpToWriteRequest(&data, "tenant-otlp", now))["__name__=http_requests_total,instance=pod-1,job=shop/checkout,"])
+}
+
+func TestOTLPPointsWithoutTimestamp(t *testing.T) {
+	var data metricspb.MetricsData
+	assert.Nil(t, protojson.Unmarshal([]byte(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [
+	  {"name": "queue.size", "gauge": {"dataPoints": [{"asInt": "3"}]}},
+	  {"name": "jobs", "sum": {"isMonotonic": true, "aggregationTemporality": "AGGREGATION_TEMPORALITY_DELTA", "dataPoints": [{"asInt": "2"}]}}
+	]}]}]}`), &data))
+
+	// Points without timestamp take the time of the request, so deltas are
+	// accumulated once per request.
+	now := time.Unix(1700000000, 0)
+	req := otlpToWriteRequest(&data, "tenant-no-timestamp", now)
+	assert.Equal(t, []prompb.Sample{{Value: 3, Timestamp: 1700000000000}}, req.Timeseries[0].Samples)
+	assert.Equal(t, []prompb.Sample{{Value: 2, Timestamp: 1700000000000}}, req.Timeseries[1].Samples)
+
+	req = otlpToWriteRequest(&data, "tenant-no-timestamp", now.Add(time.Minute))
+	assert.Equal(t, []prompb.Sample{{Value: 4, Timestamp: 1700000060000}}, req.Timeseries[1].Samples)
+}
+
+func TestDeltaAccumulator(t *testing.T) {
+	a := &deltaAccumulator{series: map[seriesKey]*deltaSeries{}}
+	now := time.Now()
+
+	assert.Equal(t, float64(5), a.accumulate("tenant", 1, 5, 1000, now))
+	assert.Equal(t, float64(5), a.accumulate("tenant", 1, 5, 1000, now))
+	assert.Equal(t, float64(8), a.accumulate("tenant", 1, 3, 2000, now))
+	assert.Equal(t, float64(8), a.accumulate("tenant", 1, 5, 1000, now))
+	assert.Equal(t, float64(2), a.accumulate("tenant", 2, 2, 1000, now))
+	assert.Equal(t, float64(1), a.accumulate("other", 1, 1, 1000, now))
+}
+
+func TestSanitizeNames(t *testing.T) {
+	assert.Equal(t, "http_server_duration", sanitizeMetricName("http.server.duration"))
+	assert.Equal(t, "ns:metric_name", sanitizeMetricName("ns:metric-name"))
+	assert.Equal(t, "k8s_pod_name", sanitizeLabelName("k8s.pod.name"))
+	assert.Equal(t, "key_0_label", sanitizeLabelName("0.label"))
+}
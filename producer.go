@@ -0,0 +1,402 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+)
+
+// kafkaConfigMap builds the configuration of the default sink from the
+// environment.
+func kafkaConfigMap() (kafka.ConfigMap, error) {
+	return envSinkConfig().configMap()
+}
+
+// configMap builds the producer configuration of a sink.
+func (s *sinkConfig) configMap() (kafka.ConfigMap, error) {
+	return s.clientConfigMap(kafka.ConfigMap{
+		"compression.codec":   kafkaCompression,
+		"batch.num.messages":  kafkaBatchNumMessages,
+		"go.batch.producer":   true, // Enable batch producer (for increased performance).
+		"go.delivery.reports": true, // per-message delivery reports to the Events() channel
+		// Failed messages are sent back in their delivery reports, so they can
+		// be produced again when the producer is replaced.
+		"go.delivery.report.fields": "key,value,headers",
+	})
+}
+
+// consumerConfigMap builds the configuration of a consumer of a sink, which
+// commits its offsets explicitly.
+func (s *sinkConfig) consumerConfigMap(groupID string) (kafka.ConfigMap, error) {
+	return s.clientConfigMap(kafka.ConfigMap{
+		"group.id":           groupID,
+		"enable.auto.commit": false,
+		"auto.offset.reset":  "earliest",
+	})
+}
+
+// clientConfigMap adds the brokers and the security settings of a sink to the
+// properties of a client.
+func (s *sinkConfig) clientConfigMap(kafkaConfig kafka.ConfigMap) (kafka.ConfigMap, error) {
+	kafkaConfig["bootstrap.servers"] = s.Brokers
+
+	securityProtocol := strings.ToLower(s.SecurityProtocol)
+
+	if s.SSLClientCertFile != "" && s.SSLClientKeyFile != "" && s.SSLCACertFile != "" {
+		if securityProtocol == "" {
+			securityProtocol = "ssl"
+		}
+
+		if securityProtocol != "ssl" && securityProtocol != "sasl_ssl" {
+			return nil, fmt.Errorf("invalid config: kafka security protocol is not ssl based but ssl config is provided")
+		}
+
+		kafkaConfig["security.protocol"] = securityProtocol
+		kafkaConfig["ssl.ca.location"] = s.SSLCACertFile              // CA certificate file for verifying the broker's certificate.
+		kafkaConfig["ssl.certificate.location"] = s.SSLClientCertFile // Client's certificate
+		kafkaConfig["ssl.key.location"] = s.SSLClientKeyFile          // Client's key
+		kafkaConfig["ssl.key.password"] = s.sslClientKeyPass.Value()  // Key password, if any.
+	}
+
+	if strings.EqualFold(s.SASLMechanism, "OAUTHBEARER") {
+		if securityProtocol != "sasl_ssl" && securityProtocol != "sasl_plaintext" {
+			return nil, fmt.Errorf("invalid config: kafka security protocol is not sasl based but sasl config is provided")
+		}
+
+		kafkaConfig["security.protocol"] = securityProtocol
+		kafkaConfig["sasl.mechanism"] = "OAUTHBEARER"
+		o := s.OAuthBearer
+		if o == nil {
+			o = &oauthBearerConfig{}
+		}
+		if o.Method == "oidc" {
+			if o.ClientID == "" || o.TokenEndpointURL == "" {
+				return nil, fmt.Errorf("invalid config: oidc oauthbearer requires a client id and a token endpoint url")
+			}
+			kafkaConfig["sasl.oauthbearer.method"] = "oidc"
+			kafkaConfig["sasl.oauthbearer.client.id"] = o.ClientID
+			if o.clientSecret != nil {
+				kafkaConfig["sasl.oauthbearer.client.secret"] = o.clientSecret.Value()
+			}
+			kafkaConfig["sasl.oauthbearer.token.endpoint.url"] = o.TokenEndpointURL
+			if o.Scope != "" {
+				kafkaConfig["sasl.oauthbearer.scope"] = o.Scope
+			}
+			if len(o.Extensions) > 0 {
+				var extensions []string
+				for _, key := range sortedStringKeys(o.Extensions) {
+					extensions = append(extensions, key+"="+o.Extensions[key])
+				}
+				kafkaConfig["sasl.oauthbearer.extensions"] = strings.Join(extensions, ",")
+			}
+		} else if o.TokenFile == "" && o.TokenCommand == "" {
+			return nil, fmt.Errorf("invalid config: oauthbearer requires a token file or command, or the oidc method")
+		}
+	} else if s.SASLMechanism != "" && s.SASLUsername != "" && s.saslPassword.Value() != "" {
+		if securityProtocol != "sasl_ssl" && securityProtocol != "sasl_plaintext" {
+			return nil, fmt.Errorf("invalid config: kafka security protocol is not sasl based but sasl config is provided")
+		}
+
+		kafkaConfig["security.protocol"] = securityProtocol
+		kafkaConfig["sasl.mechanism"] = s.SASLMechanism
+		kafkaConfig["sasl.username"] = s.SASLUsername
+		kafkaConfig["sasl.password"] = s.saslPassword.Value()
+	}
+
+	// Raw librdkafka properties take precedence over everything else.
+	for key, value := range s.Config {
+		kafkaConfig[key] = value
+	}
+
+	return kafkaConfig, nil
+}
+
+// files returns the files holding the tls material and the secrets of the
+// sink, whose producer is rebuilt when they change.
+func (s *sinkConfig) files() []string {
+	var files []string
+	for _, file := range []string{s.SSLClientCertFile, s.SSLClientKeyFile, s.SSLCACertFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return append(files, secretFiles(s.secrets()...)...)
+}
+
+// secrets returns the secrets used by the sink.
+func (s *sinkConfig) secrets() []*secret {
+	secrets := []*secret{s.sslClientKeyPass, s.saslPassword}
+	if strings.EqualFold(s.SASLMechanism, "OAUTHBEARER") && s.OAuthBearer != nil && s.OAuthBearer.clientSecret != nil {
+		secrets = append(secrets, s.OAuthBearer.clientSecret)
+	}
+	return secrets
+}
+
+// kafkaProducer is the part of a kafka producer used by the sinks.
+type kafkaProducer interface {
+	oauthBearerTokenSetter
+	Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+	Events() chan kafka.Event
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error)
+	Flush(timeoutMs int) int
+	Purge(flags int) error
+	Close()
+}
+
+// newKafkaProducer creates a kafka producer from its configuration.
+func newKafkaProducer(kafkaConfig *kafka.ConfigMap) (kafkaProducer, error) {
+	producer, err := kafka.NewProducer(kafkaConfig)
+	if err != nil {
+		return nil, err
+	}
+	return producer, nil
+}
+
+// reloadableProducer is a kafka producer that can be replaced by a new one,
+// built from a fresh configuration, without losing the queued messages.
+type reloadableProducer struct {
+	name     string
+	mu       sync.RWMutex
+	producer kafkaProducer
+	config   func() (kafka.ConfigMap, error)
+	// connect creates the kafka producers.
+	connect func(*kafka.ConfigMap) (kafkaProducer, error)
+	// down is set while all the brokers are unreachable, until a message is
+	// delivered again.
+	down int32
+	// retired holds the replaced producers being purged, so their event loops
+	// can tell purged messages apart from regular delivery failures.
+	retired map[kafkaProducer]bool
+	// fallback, when set, is given the messages that couldn't be delivered,
+	// and tells whether it took care of them.
+	fallback func(*kafka.Message) bool
+	// oauthBearer holds the OAUTHBEARER settings of the sink, if any, and
+	// refreshers the token refresher of every open producer.
+	oauthBearer *oauthBearerConfig
+	refreshers  map[kafkaProducer]*oauthBearerRefresher
+}
+
+// newReloadableProducer creates the producer of a sink with the configuration
+// returned by config, which is called again on every reload.
+func newReloadableProducer(name string, config func() (kafka.ConfigMap, error), oauthBearer *oauthBearerConfig) (*reloadableProducer, error) {
+	p := &reloadableProducer{
+		name:        name,
+		config:      config,
+		connect:     newKafkaProducer,
+		retired:     map[kafkaProducer]bool{},
+		oauthBearer: oauthBearer,
+		refreshers:  map[kafkaProducer]*oauthBearerRefresher{},
+	}
+	sinkUp.WithLabelValues(name).Set(1)
+
+	kafkaConfig, err := config()
+	if err != nil {
+		return nil, err
+	}
+	if p.producer, err = p.newProducer(kafkaConfig); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Produce enqueues a message in the current producer.
+func (p *reloadableProducer) Produce(msg *kafka.Message) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.producer.Produce(msg, nil)
+}
+
+// probe requests the metadata of the cluster, updating the health of the
+// sink.
+func (p *reloadableProducer) probe(timeout time.Duration) error {
+	p.mu.RLock()
+	producer := p.producer
+	p.mu.RUnlock()
+
+	_, err := producer.GetMetadata(nil, false, int(timeout.Milliseconds()))
+	p.setHealthy(err == nil)
+	return err
+}
+
+func (p *reloadableProducer) setFallback(fallback func(*kafka.Message) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fallback = fallback
+}
+
+// healthy tells whether the brokers of the sink are reachable.
+func (p *reloadableProducer) healthy() bool {
+	return atomic.LoadInt32(&p.down) == 0
+}
+
+func (p *reloadableProducer) setHealthy(healthy bool) {
+	var down int32
+	if !healthy {
+		down = 1
+	}
+	if atomic.SwapInt32(&p.down, down) == down {
+		return
+	}
+	if healthy {
+		sinkUp.WithLabelValues(p.name).Set(1)
+		logrus.WithField("sink", p.name).Info("kafka sink is reachable again")
+	} else {
+		sinkUp.WithLabelValues(p.name).Set(0)
+		logrus.WithField("sink", p.name).Warn("all the brokers of the kafka sink are down")
+	}
+}
+
+// reload replaces the current producer by a new one. The old producer is
+// drained in the background, and the messages it can't deliver in time are
+// produced again in the new one.
+func (p *reloadableProducer) reload() error {
+	kafkaConfig, err := p.config()
+	if err != nil {
+		return err
+	}
+	producer, err := p.newProducer(kafkaConfig)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	old := p.producer
+	p.producer = producer
+	p.mu.Unlock()
+
+	go p.retire(old)
+	return nil
+}
+
+// retire flushes a replaced producer and closes it. Messages still queued
+// after the drain timeout are purged, which sends them back to the event loop
+// to be produced again.
+func (p *reloadableProducer) retire(producer kafkaProducer) {
+	if remaining := producer.Flush(int(kafkaProducerDrainTimeout.Milliseconds())); remaining > 0 {
+		logrus.WithFields(logrus.Fields{"sink": p.name, "remaining": remaining}).Warn("couldn't flush the replaced kafka producer, moving its messages to the new one")
+
+		p.mu.Lock()
+		p.retired[producer] = true
+		p.mu.Unlock()
+
+		if err := producer.Purge(kafka.PurgeQueue | kafka.PurgeInFlight); err != nil {
+			logrus.WithError(err).Error("couldn't purge the replaced kafka producer")
+		}
+		producer.Flush(int(kafkaProducerDrainTimeout.Milliseconds()))
+	}
+
+	p.mu.Lock()
+	refresher := p.refreshers[producer]
+	delete(p.refreshers, producer)
+	p.mu.Unlock()
+	refresher.close()
+
+	producer.Close()
+	logrus.WithField("sink", p.name).Info("replaced kafka producer closed")
+}
+
+// newProducer creates a kafka producer and starts handling its events.
+func (p *reloadableProducer) newProducer(kafkaConfig kafka.ConfigMap) (kafkaProducer, error) {
+	logrus.WithField("config", redactConfigMap(kafkaConfig)).Debug("creating kafka producer")
+
+	producer, err := p.connect(&kafkaConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	refresher := newOAuthBearerRefresher(p.name, p.oauthBearer, producer)
+	p.mu.Lock()
+	p.refreshers[producer] = refresher
+	p.mu.Unlock()
+
+	go p.handleEvents(producer, refresher)
+	return producer, nil
+}
+
+// handleEvents processes the events of a producer until it is closed.
+func (p *reloadableProducer) handleEvents(producer kafkaProducer, refresher *oauthBearerRefresher) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.retired, producer)
+		p.mu.Unlock()
+	}()
+
+	for e := range producer.Events() {
+		switch ev := e.(type) {
+		case *kafka.Message:
+			if ev.TopicPartition.Error != nil {
+				p.deliveryFailed(producer, ev)
+			} else {
+				p.setHealthy(true)
+				recordDelivery(p.name, ev, true)
+			}
+		case kafka.OAuthBearerTokenRefresh:
+			refresher.refresh()
+		case kafka.Error:
+			if ev.Code() == kafka.ErrAllBrokersDown {
+				p.setHealthy(false)
+			}
+			logrus.WithError(ev).WithFields(logrus.Fields{"sink": p.name, "code": ev.Code()}).Error("kafka producer error")
+		default:
+			logrus.WithField("event", ev.String()).Debug("ignored kafka producer event")
+		}
+	}
+}
+
+// deliveryFailed handles a failed delivery report. Messages purged from a
+// replaced producer are produced again in the current one, the others are
+// handed to the fallback, if any.
+func (p *reloadableProducer) deliveryFailed(producer kafkaProducer, msg *kafka.Message) {
+	p.mu.RLock()
+	retired := p.retired[producer]
+	fallback := p.fallback
+	p.mu.RUnlock()
+
+	if retired {
+		if err, ok := msg.TopicPartition.Error.(kafka.Error); ok && (err.Code() == kafka.ErrPurgeQueue || err.Code() == kafka.ErrPurgeInflight) {
+			msg.TopicPartition.Partition = kafka.PartitionAny
+			msg.TopicPartition.Error = nil
+			if err := p.Produce(msg); err == nil {
+				return
+			}
+		}
+	}
+
+	recordDelivery(p.name, msg, false)
+	if fallback != nil && fallback(msg) {
+		return
+	}
+
+	objectsFailed.Add(float64(1))
+	sinkFailed.WithLabelValues(p.name).Inc()
+	logrus.WithError(msg.TopicPartition.Error).WithField("sink", p.name).Error(fmt.Sprintf("couldn't deliver message to kafka topic %v", *msg.TopicPartition.Topic))
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
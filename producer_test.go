@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProducer queues the produced messages until they are flushed, or
+// purged back to its event loop.
+type fakeProducer struct {
+	mu       sync.Mutex
+	queued   []*kafka.Message
+	produced chan *kafka.Message
+	events   chan kafka.Event
+	// undeliverable keeps the messages queued when flushing.
+	undeliverable bool
+	flushes       int
+	purges        []int
+	closed        chan struct{}
+}
+
+func newFakeProducer(undeliverable bool) *fakeProducer {
+	return &fakeProducer{
+		produced:      make(chan *kafka.Message, 10),
+		events:        make(chan kafka.Event, 10),
+		undeliverable: undeliverable,
+		closed:        make(chan struct{}),
+	}
+}
+
+func (f *fakeProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queued = append(f.queued, msg)
+	f.produced <- msg
+	return nil
+}
+
+func (f *fakeProducer) Events() chan kafka.Event {
+	return f.events
+}
+
+func (f *fakeProducer) GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error) {
+	return &kafka.Metadata{}, nil
+}
+
+func (f *fakeProducer) Flush(timeoutMs int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flushes++
+	if !f.undeliverable {
+		f.queued = nil
+	}
+	return len(f.queued)
+}
+
+func (f *fakeProducer) Purge(flags int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.purges = append(f.purges, flags)
+	for _, msg := range f.queued {
+		msg.TopicPartition.Error = kafka.NewError(kafka.ErrPurgeQueue, "purged", false)
+		f.events <- msg
+	}
+	f.queued = nil
+	return nil
+}
+
+func (f *fakeProducer) Close() {
+	close(f.events)
+	close(f.closed)
+}
+
+func (f *fakeProducer) SetOAuthBearerToken(kafka.OAuthBearerToken) error {
+	return nil
+}
+
+func (f *fakeProducer) SetOAuthBearerTokenFailure(string) error {
+	return nil
+}
+
+// newTestProducer creates a reloadable producer connecting to the given fake
+// producers, in order.
+func newTestProducer(t *testing.T, fakes ...*fakeProducer) *reloadableProducer {
+	p := &reloadableProducer{
+		name:   "test",
+		config: func() (kafka.ConfigMap, error) { return kafka.ConfigMap{}, nil },
+		connect: func(*kafka.ConfigMap) (kafkaProducer, error) {
+			f := fakes[0]
+			fakes = fakes[1:]
+			return f, nil
+		},
+		retired:    map[kafkaProducer]bool{},
+		refreshers: map[kafkaProducer]*oauthBearerRefresher{},
+	}
+	var err error
+	p.producer, err = p.newProducer(kafka.ConfigMap{})
+	assert.Nil(t, err)
+	return p
+}
+
+func waitClosed(t *testing.T, f *fakeProducer) {
+	select {
+	case <-f.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replaced producer not closed")
+	}
+}
+
+func TestReloadableProducerRetire(t *testing.T) {
+	topic := "metrics"
+	newMessage := func(value string) *kafka.Message {
+		return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 3}, Value: []byte(value)}
+	}
+
+	// Flushed producers are closed without being purged.
+	old, current := newFakeProducer(false), newFakeProducer(false)
+	p := newTestProducer(t, old, current)
+	assert.Nil(t, p.Produce(newMessage("a")))
+	<-old.produced
+	assert.Nil(t, p.reload())
+	waitClosed(t, old)
+	assert.Equal(t, 1, old.flushes)
+	assert.Empty(t, old.purges)
+	assert.Len(t, current.produced, 0)
+
+	// The messages that couldn't be flushed are purged and produced again in
+	// the new producer.
+	old, current = newFakeProducer(true), newFakeProducer(false)
+	p = newTestProducer(t, old, current)
+	assert.Nil(t, p.Produce(newMessage("a")))
+	assert.Nil(t, p.Produce(newMessage("b")))
+	<-old.produced
+	<-old.produced
+	assert.Nil(t, p.reload())
+	for _, value := range []string{"a", "b"} {
+		select {
+		case msg := <-current.produced:
+			assert.Equal(t, value, string(msg.Value))
+			assert.Equal(t, kafka.PartitionAny, msg.TopicPartition.Partition)
+			assert.Nil(t, msg.TopicPartition.Error)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %q not produced again", value)
+		}
+	}
+	waitClosed(t, old)
+	assert.Equal(t, 2, old.flushes, "purged messages are flushed before closing")
+	assert.Equal(t, []int{kafka.PurgeQueue | kafka.PurgeInFlight}, old.purges)
+
+	// Messages are produced in the new producer once reloaded.
+	assert.Nil(t, p.Produce(newMessage("c")))
+	assert.Equal(t, "c", string((<-current.produced).Value))
+}
+
+func TestReloadableProducerFailedReload(t *testing.T) {
+	current := newFakeProducer(false)
+	p := newTestProducer(t, current)
+	p.config = func() (kafka.ConfigMap, error) { return nil, errors.New("invalid config") }
+	assert.NotNil(t, p.reload())
+
+	p.connect = func(*kafka.ConfigMap) (kafkaProducer, error) { return nil, errors.New("couldn't connect") }
+	p.config = func() (kafka.ConfigMap, error) { return kafka.ConfigMap{}, nil }
+	assert.NotNil(t, p.reload())
+
+	assert.Equal(t, current, p.producer, "failed reloads keep the current producer")
+	select {
+	case <-current.closed:
+		t.Fatal("current producer closed by a failed reload")
+	default:
+	}
+}
@@ -19,7 +19,7 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func processWriteRequest(req *prompb.WriteRequest) (map[string][][]byte, error) {
+func processWriteRequest(req *prompb.WriteRequest, tenant string) (map[destination][]record, error) {
 	logrus.WithField("var", req).Debugln()
-	return Serialize(serializer, req)
+	return serializeRecords(serializer, req, tenant)
 }
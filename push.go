@@ -0,0 +1,215 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+const openMetricsType = "application/openmetrics-text"
+
+// pushHandler accepts metrics in exposition format the way the Pushgateway
+// does, on /push/job/<job>/{label}/{value}... The labels of the path are
+// attached to every series.
+func pushHandler(serializer Serializer) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		httpRequestsTotal.Add(float64(1))
+
+		meta, ok := ingestMeta(c)
+		if !ok {
+			return
+		}
+
+		grouping, err := parseGroupingKey(c.Param("path"))
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			c.Abort()
+			return
+		}
+
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			logrus.WithError(err).Error("couldn't read body")
+			return
+		}
+
+		req, err := pushToWriteRequest(body, c.Request.Header, grouping, time.Now())
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			c.Abort()
+			logrus.WithError(err).Error("couldn't parse pushed metrics")
+			return
+		}
+
+		status, err := ingest(serializer, req, meta, requestIdentity(c), len(body))
+		respondIngest(c, status, err)
+	}
+}
+
+// parseGroupingKey parses the labels of a push path, job/<job>/{label}/{value}...
+// Values of labels suffixed by @base64 are base64url encoded, which allows
+// values with slashes or empty ones.
+func parseGroupingKey(path string) (model.LabelSet, error) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments)%2 != 0 {
+		return nil, fmt.Errorf("odd number of segments in the grouping key %q", path)
+	}
+	if name := strings.TrimSuffix(segments[0], "@base64"); name != "job" {
+		return nil, fmt.Errorf("the grouping key must start with the job, got %q", segments[0])
+	}
+
+	grouping := model.LabelSet{}
+	for i := 0; i < len(segments); i += 2 {
+		name, value := segments[i], segments[i+1]
+		if strings.HasSuffix(name, "@base64") {
+			name = strings.TrimSuffix(name, "@base64")
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value of label %q: %s", name, err)
+			}
+			value = string(decoded)
+		}
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label name %q in the grouping key", name)
+		}
+		if _, ok := grouping[model.LabelName(name)]; ok {
+			return nil, fmt.Errorf("duplicate label %q in the grouping key", name)
+		}
+		grouping[model.LabelName(name)] = model.LabelValue(value)
+	}
+	if grouping["job"] == "" {
+		return nil, fmt.Errorf("the job can't be empty")
+	}
+	return grouping, nil
+}
+
+// pushToWriteRequest parses metrics in OpenMetrics, text or protobuf
+// exposition format, as told by the content type. Samples without timestamp
+// take the time of the request.
+func pushToWriteRequest(body []byte, header http.Header, grouping model.LabelSet, now time.Time) (*prompb.WriteRequest, error) {
+	var samples model.Vector
+	var err error
+	if mediatype, _, _ := mime.ParseMediaType(header.Get("Content-Type")); mediatype == openMetricsType {
+		samples, err = openMetricsSamples(body, now)
+	} else {
+		samples, err = expositionSamples(body, expfmt.ResponseFormat(header), now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req := &prompb.WriteRequest{}
+	series := map[model.Fingerprint]int{}
+	for _, s := range samples {
+		for name, value := range grouping {
+			if existing, ok := s.Metric[name]; ok && existing != value {
+				return nil, fmt.Errorf("label %s=%q of series %s conflicts with the grouping key", name, existing, s.Metric)
+			}
+			s.Metric[name] = value
+		}
+
+		sample := prompb.Sample{Value: float64(s.Value), Timestamp: int64(s.Timestamp)}
+		fp := s.Metric.Fingerprint()
+		if i, ok := series[fp]; ok {
+			req.Timeseries[i].Samples = append(req.Timeseries[i].Samples, sample)
+			continue
+		}
+		series[fp] = len(req.Timeseries)
+
+		ls := make([]prompb.Label, 0, len(s.Metric))
+		for name, value := range s.Metric {
+			ls = append(ls, prompb.Label{Name: string(name), Value: string(value)})
+		}
+		sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{Labels: ls, Samples: []prompb.Sample{sample}})
+	}
+	return req, nil
+}
+
+// expositionSamples parses metrics in text or protobuf exposition format.
+func expositionSamples(body []byte, format expfmt.Format, now time.Time) (model.Vector, error) {
+	decoder := expfmt.NewDecoder(bytes.NewReader(body), format)
+	var families []*dto.MetricFamily
+	for {
+		mf := &dto.MetricFamily{}
+		if err := decoder.Decode(mf); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		families = append(families, mf)
+	}
+	return expfmt.ExtractSamples(&expfmt.DecodeOptions{Timestamp: model.TimeFromUnixNano(now.UnixNano())}, families...)
+}
+
+// openMetricsSamples parses metrics in OpenMetrics format, which expfmt can
+// only write. The # EOF marker is optional, as it is easy to forget it with
+// curl.
+func openMetricsSamples(body []byte, now time.Time) (model.Vector, error) {
+	trimmed := bytes.TrimRight(body, "\n")
+	if !bytes.HasSuffix(trimmed, []byte("# EOF")) {
+		body = append(trimmed, []byte("\n# EOF\n")...)
+	}
+
+	var samples model.Vector
+	parser := textparse.NewOpenMetricsParser(body)
+	for {
+		entry, err := parser.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry != textparse.EntrySeries {
+			continue
+		}
+
+		_, ts, v := parser.Series()
+		var lset labels.Labels
+		parser.Metric(&lset)
+
+		s := &model.Sample{Metric: make(model.Metric, len(lset)), Value: model.SampleValue(v), Timestamp: model.TimeFromUnixNano(now.UnixNano())}
+		if ts != nil {
+			s.Timestamp = model.Time(*ts)
+		}
+		for _, l := range lset {
+			s.Metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGroupingKey(t *testing.T) {
+	grouping, err := parseGroupingKey("/job/backup/instance@base64/aG9zdC9h/empty@base64/=")
+	assert.Nil(t, err)
+	assert.Equal(t, model.LabelSet{"job": "backup", "instance": "host/a", "empty": ""}, grouping)
+
+	for _, path := range []string{
+		"/job",
+		"/job/",
+		"/instance/a/job/backup",
+		"/job/backup/__name__/x",
+		"/job/backup/in-valid/x",
+		"/job/backup/job/again",
+		"/job/backup/x@base64/!!",
+	} {
+		_, err := parseGroupingKey(path)
+		assert.NotNil(t, err, path)
+	}
+}
+
+func TestPushToWriteRequest(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	grouping := model.LabelSet{"job": "backup"}
+
+	text := "# TYPE backup_duration_seconds summary\n" +
+		"backup_duration_seconds{quantile=\"0.5\"} 12\n" +
+		"backup_duration_seconds_sum 30\n" +
+		"backup_duration_seconds_count 2\n" +
+		"backup_last_success 1600000000 1600000000000\n"
+	req, err := pushToWriteRequest([]byte(text), http.Header{}, grouping, now)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "backup_duration_seconds"}, {Name: "job", Value: "backup"}, {Name: "quantile", Value: "0.5"}},
+			Samples: []prompb.Sample{{Value: 12, Timestamp: 1700000000000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "backup_duration_seconds_sum"}, {Name: "job", Value: "backup"}},
+			Samples: []prompb.Sample{{Value: 30, Timestamp: 1700000000000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "backup_duration_seconds_count"}, {Name: "job", Value: "backup"}},
+			Samples: []prompb.Sample{{Value: 2, Timestamp: 1700000000000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "backup_last_success"}, {Name: "job", Value: "backup"}},
+			Samples: []prompb.Sample{{Value: 1600000000, Timestamp: 1600000000000}},
+		},
+	}, req.Timeseries)
+
+	openMetrics := "# TYPE backup_files counter\n" +
+		"backup_files_total{kind=\"full\"} 7 1600000000.5 # {trace_id=\"abc\"} 1\n" +
+		"backup_files_total{kind=\"incremental\"} 3\n"
+	header := http.Header{"Content-Type": []string{"application/openmetrics-text; version=1.0.0"}}
+	req, err = pushToWriteRequest([]byte(openMetrics), header, grouping, now)
+	assert.Nil(t, err)
+	assert.Equal(t, []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "backup_files_total"}, {Name: "job", Value: "backup"}, {Name: "kind", Value: "full"}},
+			Samples: []prompb.Sample{{Value: 7, Timestamp: 1600000000500}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "backup_files_total"}, {Name: "job", Value: "backup"}, {Name: "kind", Value: "incremental"}},
+			Samples: []prompb.Sample{{Value: 3, Timestamp: 1700000000000}},
+		},
+	}, req.Timeseries)
+
+	_, err = pushToWriteRequest([]byte("up{job=\"other\"} 1\n"), http.Header{}, grouping, now)
+	assert.NotNil(t, err)
+
+	_, err = pushToWriteRequest([]byte("not valid {\n"), http.Header{}, grouping, now)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reloadable is a piece of configuration loaded from files, reloaded on SIGHUP
+// and whenever one of its files changes.
+type reloadable struct {
+	name   string
+	paths  []string
+	reload func() error
+
+	stats map[string]fileStat
+}
+
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+var (
+	reloadablesMu sync.Mutex
+	reloadables   []*reloadable
+)
+
+// registerReload registers a function reloading the configuration read from
+// the given files.
+func registerReload(name string, paths []string, reload func() error) {
+	r := &reloadable{name: name, paths: paths, reload: reload}
+	r.stats = r.statFiles()
+
+	reloadablesMu.Lock()
+	defer reloadablesMu.Unlock()
+	reloadables = append(reloadables, r)
+}
+
+// startReloader reloads the registered configuration on SIGHUP and polls
+// their files for changes every interval.
+func startReloader(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	go func() {
+		for {
+			select {
+			case <-hup:
+				logrus.Info("SIGHUP received, reloading configuration")
+				reloadAll(true)
+			case <-tick:
+				reloadAll(false)
+			}
+		}
+	}()
+}
+
+func reloadAll(force bool) {
+	reloadablesMu.Lock()
+	defer reloadablesMu.Unlock()
+
+	for _, r := range reloadables {
+		stats := r.statFiles()
+		if !force && !r.changed(stats) {
+			continue
+		}
+		r.stats = stats
+
+		if err := r.reload(); err != nil {
+			configReloadsTotal.WithLabelValues(r.name, "failure").Inc()
+			configLastReloadSuccessful.WithLabelValues(r.name).Set(0)
+			logrus.WithError(err).WithField("config", r.name).Error("couldn't reload configuration, keeping the previous one")
+			continue
+		}
+		configReloadsTotal.WithLabelValues(r.name, "success").Inc()
+		configLastReloadSuccessful.WithLabelValues(r.name).Set(1)
+		logrus.WithField("config", r.name).Info("configuration reloaded")
+	}
+}
+
+func (r *reloadable) statFiles() map[string]fileStat {
+	stats := make(map[string]fileStat, len(r.paths))
+	for _, path := range r.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		stats[path] = fileStat{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stats
+}
+
+func (r *reloadable) changed(stats map[string]fileStat) bool {
+	if len(stats) != len(r.stats) {
+		return true
+	}
+	for path, s := range stats {
+		if r.stats[path] != s {
+			return true
+		}
+	}
+	return false
+}
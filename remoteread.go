@@ -0,0 +1,478 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/gin-gonic/gin"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/sirupsen/logrus"
+)
+
+// samplesPerChunk is the number of samples of the XOR chunks streamed to the
+// clients, as in the Prometheus head block.
+const samplesPerChunk = 120
+
+// readBuffer keeps the most recent samples of the ingested series in memory,
+// to answer remote read requests. Each series holds a ring of samples, and
+// the least recently written series are evicted once the buffer is full.
+type readBuffer struct {
+	mu               sync.Mutex
+	samplesPerSeries int
+	maxSeries        int
+	series           map[seriesKey]*list.Element
+	lru              *list.List
+}
+
+type bufferedSeries struct {
+	key     seriesKey
+	labels  []prompb.Label
+	samples []prompb.Sample
+	next    int
+}
+
+// remoteReadBuffer is nil when the remote read endpoint is disabled.
+var remoteReadBuffer *readBuffer
+
+func newReadBuffer(samplesPerSeries, maxSeries int) *readBuffer {
+	return &readBuffer{
+		samplesPerSeries: samplesPerSeries,
+		maxSeries:        maxSeries,
+		series:           map[seriesKey]*list.Element{},
+		lru:              list.New(),
+	}
+}
+
+// appendRequest buffers the samples of the request that pass the match
+// rules of the tenant, as those are the ones produced.
+func (b *readBuffer) appendRequest(tenant string, req *prompb.WriteRequest) {
+	matchRules := tenantMatch(overridesFor(tenant))
+	for _, ts := range req.Timeseries {
+		if len(matchRules) > 0 {
+			labels := make(map[string]string, len(ts.Labels))
+			for _, l := range ts.Labels {
+				labels[l.Name] = l.Value
+			}
+			if !filterMatch(matchRules, labels["__name__"], labels) {
+				continue
+			}
+		}
+		b.append(tenant, ts.Labels, ts.Samples)
+	}
+}
+
+func (b *readBuffer) append(tenant string, lbls []prompb.Label, samples []prompb.Sample) {
+	if len(samples) == 0 {
+		return
+	}
+
+	if !sort.SliceIsSorted(lbls, func(i, j int) bool { return lbls[i].Name < lbls[j].Name }) {
+		lbls = append([]prompb.Label(nil), lbls...)
+		sort.Slice(lbls, func(i, j int) bool { return lbls[i].Name < lbls[j].Name })
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := seriesKey{tenant, hashLabels(lbls)}
+	e, ok := b.series[key]
+	if ok {
+		b.lru.MoveToFront(e)
+	} else {
+		e = b.lru.PushFront(&bufferedSeries{key: key, labels: append([]prompb.Label(nil), lbls...)})
+		b.series[key] = e
+		for b.lru.Len() > b.maxSeries {
+			oldest := b.lru.Back()
+			b.lru.Remove(oldest)
+			delete(b.series, oldest.Value.(*bufferedSeries).key)
+		}
+		remoteReadBufferSeries.Set(float64(b.lru.Len()))
+	}
+
+	s := e.Value.(*bufferedSeries)
+	for _, sample := range samples {
+		if len(s.samples) < b.samplesPerSeries {
+			s.samples = append(s.samples, sample)
+			continue
+		}
+		s.samples[s.next] = sample
+		s.next = (s.next + 1) % b.samplesPerSeries
+	}
+}
+
+// query returns the series of the tenant selected by the matchers, with
+// their samples between start and end sorted by timestamp. The series are
+// sorted by their labels.
+func (b *readBuffer) query(tenant string, matchers []*labels.Matcher, start, end int64) []*prompb.TimeSeries {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var result []*prompb.TimeSeries
+	for key, e := range b.series {
+		if key.tenant != tenant {
+			continue
+		}
+		s := e.Value.(*bufferedSeries)
+		if !matchLabels(matchers, s.labels) {
+			continue
+		}
+
+		// The ring is walked from its oldest sample, so that the latest of
+		// the samples sharing a timestamp wins.
+		var samples []prompb.Sample
+		for _, ring := range [][]prompb.Sample{s.samples[s.next:], s.samples[:s.next]} {
+			for _, sample := range ring {
+				if sample.Timestamp >= start && sample.Timestamp <= end {
+					samples = append(samples, sample)
+				}
+			}
+		}
+		if len(samples) == 0 {
+			continue
+		}
+
+		// Seeded and ingested samples may be out of order or repeated.
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+		deduped := samples[:1]
+		for _, sample := range samples[1:] {
+			if sample.Timestamp == deduped[len(deduped)-1].Timestamp {
+				deduped[len(deduped)-1] = sample
+				continue
+			}
+			deduped = append(deduped, sample)
+		}
+
+		result = append(result, &prompb.TimeSeries{
+			Labels:  append([]prompb.Label(nil), s.labels...),
+			Samples: deduped,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return labels.Compare(labelsFromProto(result[i].Labels), labelsFromProto(result[j].Labels)) < 0
+	})
+	return result
+}
+
+func matchLabels(matchers []*labels.Matcher, lbls []prompb.Label) bool {
+	for _, m := range matchers {
+		value := ""
+		for _, l := range lbls {
+			if l.Name == m.Name {
+				value = l.Value
+				break
+			}
+		}
+		if !m.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func labelsFromProto(lbls []prompb.Label) labels.Labels {
+	result := make(labels.Labels, 0, len(lbls))
+	for _, l := range lbls {
+		result = append(result, labels.Label{Name: l.Name, Value: l.Value})
+	}
+	return result
+}
+
+func matchersFromProto(matchers []*prompb.LabelMatcher) ([]*labels.Matcher, error) {
+	result := make([]*labels.Matcher, 0, len(matchers))
+	for _, m := range matchers {
+		var t labels.MatchType
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			t = labels.MatchEqual
+		case prompb.LabelMatcher_NEQ:
+			t = labels.MatchNotEqual
+		case prompb.LabelMatcher_RE:
+			t = labels.MatchRegexp
+		case prompb.LabelMatcher_NRE:
+			t = labels.MatchNotRegexp
+		default:
+			return nil, fmt.Errorf("invalid matcher type %v", m.Type)
+		}
+		matcher, err := labels.NewMatcher(t, m.Name, m.Value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, matcher)
+	}
+	return result, nil
+}
+
+// negotiateResponseType picks the first response type accepted by the
+// client, samples when it doesn't say.
+func negotiateResponseType(accepted []prompb.ReadRequest_ResponseType) (prompb.ReadRequest_ResponseType, error) {
+	if len(accepted) == 0 {
+		return prompb.ReadRequest_SAMPLES, nil
+	}
+	for _, t := range accepted {
+		switch t {
+		case prompb.ReadRequest_SAMPLES, prompb.ReadRequest_STREAMED_XOR_CHUNKS:
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("none of the accepted response types %v is supported", accepted)
+}
+
+// readHandler answers remote read requests from the read buffer.
+func readHandler(buffer *readBuffer) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		httpRequestsTotal.Add(float64(1))
+
+		meta, ok := ingestMeta(c)
+		if !ok {
+			return
+		}
+
+		compressed, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			logrus.WithError(err).Error("couldn't read body")
+			return
+		}
+
+		reqBuf, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			logrus.WithError(err).Error("couldn't decompress body")
+			return
+		}
+
+		var req prompb.ReadRequest
+		if err := proto.Unmarshal(reqBuf, &req); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			logrus.WithError(err).Error("couldn't unmarshal body")
+			return
+		}
+
+		responseType, err := negotiateResponseType(req.AcceptedResponseTypes)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			c.Abort()
+			return
+		}
+
+		results := make([][]*prompb.TimeSeries, len(req.Queries))
+		for i, q := range req.Queries {
+			matchers, err := matchersFromProto(q.Matchers)
+			if err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				c.Abort()
+				return
+			}
+			results[i] = buffer.query(meta.tenant, matchers, q.StartTimestampMs, q.EndTimestampMs)
+		}
+		remoteReadRequests.WithLabelValues(responseType.String()).Inc()
+
+		if responseType == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+			c.Header("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+			c.Status(http.StatusOK)
+			if err := streamChunks(c.Writer, results); err != nil {
+				logrus.WithError(err).Error("couldn't stream remote read response")
+			}
+			return
+		}
+
+		resp := prompb.ReadResponse{Results: make([]*prompb.QueryResult, len(results))}
+		for i, series := range results {
+			resp.Results[i] = &prompb.QueryResult{Timeseries: series}
+		}
+		data, err := proto.Marshal(&resp)
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			logrus.WithError(err).Error("couldn't marshal remote read response")
+			return
+		}
+		c.Header("Content-Encoding", "snappy")
+		c.Data(http.StatusOK, "application/x-protobuf", snappy.Encode(nil, data))
+	}
+}
+
+// streamChunks writes a frame per series: the uvarint size of the
+// ChunkedReadResponse, its big endian CRC32 Castagnoli checksum and the
+// message itself. Every frame is flushed as soon as it is written.
+func streamChunks(w io.Writer, results [][]*prompb.TimeSeries) error {
+	table := crc32.MakeTable(crc32.Castagnoli)
+	flusher, _ := w.(http.Flusher)
+
+	for i, series := range results {
+		for _, ts := range series {
+			chunks, err := xorChunks(ts.Samples)
+			if err != nil {
+				return err
+			}
+			data, err := proto.Marshal(&prompb.ChunkedReadResponse{
+				ChunkedSeries: []*prompb.ChunkedSeries{{Labels: ts.Labels, Chunks: chunks}},
+				QueryIndex:    int64(i),
+			})
+			if err != nil {
+				return err
+			}
+
+			var header [binary.MaxVarintLen64 + 4]byte
+			n := binary.PutUvarint(header[:], uint64(len(data)))
+			binary.BigEndian.PutUint32(header[n:], crc32.Checksum(data, table))
+			if _, err := w.Write(header[:n+4]); err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	return nil
+}
+
+// xorChunks encodes sorted samples in XOR chunks of samplesPerChunk samples.
+func xorChunks(samples []prompb.Sample) ([]prompb.Chunk, error) {
+	var chunks []prompb.Chunk
+	for len(samples) > 0 {
+		n := len(samples)
+		if n > samplesPerChunk {
+			n = samplesPerChunk
+		}
+
+		chunk := chunkenc.NewXORChunk()
+		app, err := chunk.Appender()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range samples[:n] {
+			app.Append(s.Timestamp, s.Value)
+		}
+		chunks = append(chunks, prompb.Chunk{
+			MinTimeMs: samples[0].Timestamp,
+			MaxTimeMs: samples[n-1].Timestamp,
+			Type:      prompb.Chunk_XOR,
+			Data:      chunk.Bytes(),
+		})
+		samples = samples[n:]
+	}
+	return chunks, nil
+}
+
+// seedReadBuffer fills the buffer with the records produced to the topics
+// since the lookback, reading every partition up to its high watermark or its
+// end, whichever comes first, until the timeout.
+func seedReadBuffer(buffer *readBuffer, topics []string, lookback, timeout time.Duration) error {
+	start := time.Now()
+	sink := envSinkConfig()
+	config, err := sink.consumerConfigMap("prometheus-kafka-adapter-read-" + instanceID)
+	if err != nil {
+		return err
+	}
+	config["enable.partition.eof"] = true
+	consumer, err := kafka.NewConsumer(&config)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+	refresher := newOAuthBearerRefresher(defaultSinkName, sink.OAuthBearer, consumer)
+	defer refresher.close()
+
+	partitions, err := partitionsSince(consumer, topics, time.Now().Add(-lookback))
+	if err != nil {
+		return err
+	}
+
+	// The partitions are read up to their current high watermark.
+	remaining := map[topicPartition]kafka.Offset{}
+	var assigned []kafka.TopicPartition
+	for _, p := range partitions {
+		_, high, err := consumer.QueryWatermarkOffsets(*p.Topic, p.Partition, kafkaMetadataTimeout)
+		if err != nil {
+			return err
+		}
+		if p.Offset < 0 || p.Offset >= kafka.Offset(high) {
+			continue
+		}
+		remaining[topicPartition{*p.Topic, p.Partition}] = kafka.Offset(high)
+		assigned = append(assigned, p)
+	}
+	if len(assigned) == 0 {
+		logrus.WithField("topics", topics).Info("no records to seed the remote read buffer with")
+		return nil
+	}
+	if err := consumer.Assign(assigned); err != nil {
+		return err
+	}
+
+	decoder, err := newRecordDecoder(serializationFormat())
+	if err != nil {
+		return err
+	}
+	samples := 0
+	deadline := start.Add(timeout)
+	for len(remaining) > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s with %d partitions left, %d samples seeded", timeout, len(remaining), samples)
+		}
+
+		switch ev := consumer.Poll(100).(type) {
+		case *kafka.Message:
+			key := topicPartition{*ev.TopicPartition.Topic, ev.TopicPartition.Partition}
+			if ev.TopicPartition.Offset+1 >= remaining[key] {
+				delete(remaining, key)
+			}
+
+			tenant, sample, err := decoder.decode(ev)
+			if err != nil {
+				logrus.WithError(err).WithField("topic", key.topic).Warn("couldn't decode seeded record")
+				continue
+			}
+			ts := sample.TimeSeries()
+			buffer.append(tenant, ts.Labels, ts.Samples)
+			remoteReadSeededSamples.Inc()
+			samples++
+		case kafka.PartitionEOF:
+			// Records up to the high watermark may be gone, by retention
+			// or compaction.
+			delete(remaining, topicPartition{*ev.Topic, ev.Partition})
+		case kafka.OAuthBearerTokenRefresh:
+			refresher.refresh()
+		case kafka.Error:
+			if ev.IsFatal() {
+				return ev
+			}
+			logrus.WithError(ev).Warn("error seeding the remote read buffer")
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{"samples": samples, "duration": time.Since(start)}).Info("remote read buffer seeded")
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadBuffer(t *testing.T) {
+	buffer := newReadBuffer(3, 2)
+
+	up := []prompb.Label{{Name: "job", Value: "api"}, {Name: "__name__", Value: "up"}}
+	buffer.append("", up, []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}})
+	buffer.append("", up, []prompb.Sample{{Timestamp: 4000, Value: 4}, {Timestamp: 3000, Value: 3}})
+	buffer.append("", up, []prompb.Sample{{Timestamp: 4000, Value: 5}})
+	buffer.append("team-a", up, []prompb.Sample{{Timestamp: 1000, Value: 1}})
+
+	all, _ := labels.NewMatcher(labels.MatchRegexp, "__name__", ".+")
+	series := buffer.query("", []*labels.Matcher{all}, 0, 10000)
+	assert.Equal(t, []*prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}},
+		Samples: []prompb.Sample{{Timestamp: 3000, Value: 3}, {Timestamp: 4000, Value: 5}},
+	}}, series)
+	assert.Len(t, buffer.query("", []*labels.Matcher{all}, 0, 3500)[0].Samples, 1)
+
+	other, _ := labels.NewMatcher(labels.MatchEqual, "job", "web")
+	assert.Empty(t, buffer.query("", []*labels.Matcher{other}, 0, 10000))
+
+	// The least recently written series is evicted.
+	buffer.append("", []prompb.Label{{Name: "__name__", Value: "down"}}, []prompb.Sample{{Timestamp: 1000}})
+	series = buffer.query("", []*labels.Matcher{all}, 0, 10000)
+	assert.Len(t, series, 1)
+	assert.Equal(t, "down", series[0].Labels[0].Value)
+	assert.Len(t, buffer.query("team-a", []*labels.Matcher{all}, 0, 10000), 1)
+}
+
+func TestReadHandler(t *testing.T) {
+	buffer := newReadBuffer(500, 10)
+	var samples []prompb.Sample
+	for i := 0; i < 130; i++ {
+		samples = append(samples, prompb.Sample{Timestamp: int64(i) * 1000, Value: float64(i)})
+	}
+	samples[129].Value = math.Inf(1)
+	buffer.append("", []prompb.Label{{Name: "__name__", Value: "up"}}, samples)
+
+	r := gin.New()
+	r.POST("/read", readHandler(buffer))
+
+	read := func(types ...prompb.ReadRequest_ResponseType) *httptest.ResponseRecorder {
+		data, _ := proto.Marshal(&prompb.ReadRequest{
+			Queries: []*prompb.Query{
+				{EndTimestampMs: 200000, Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "missing"}}},
+				{StartTimestampMs: 5000, EndTimestampMs: 200000, Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}},
+			},
+			AcceptedResponseTypes: types,
+		})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/read", bytes.NewReader(snappy.Encode(nil, data))))
+		return w
+	}
+
+	w := read()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "snappy", w.Header().Get("Content-Encoding"))
+	data, err := snappy.Decode(nil, w.Body.Bytes())
+	assert.Nil(t, err)
+	var resp prompb.ReadResponse
+	assert.Nil(t, proto.Unmarshal(data, &resp))
+	assert.Len(t, resp.Results, 2)
+	assert.Empty(t, resp.Results[0].Timeseries)
+	assert.Len(t, resp.Results[1].Timeseries[0].Samples, 125)
+
+	w = read(prompb.ReadRequest_STREAMED_XOR_CHUNKS, prompb.ReadRequest_SAMPLES)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse", w.Header().Get("Content-Type"))
+
+	body := bufio.NewReader(w.Body)
+	size, err := binary.ReadUvarint(body)
+	assert.Nil(t, err)
+	header := make([]byte, 4)
+	_, err = io.ReadFull(body, header)
+	assert.Nil(t, err)
+	frame := make([]byte, size)
+	_, err = io.ReadFull(body, frame)
+	assert.Nil(t, err)
+	assert.Equal(t, crc32.Checksum(frame, crc32.MakeTable(crc32.Castagnoli)), binary.BigEndian.Uint32(header))
+	rest, _ := ioutil.ReadAll(body)
+	assert.Empty(t, rest)
+
+	var chunked prompb.ChunkedReadResponse
+	assert.Nil(t, proto.Unmarshal(frame, &chunked))
+	assert.Equal(t, int64(1), chunked.QueryIndex)
+	chunks := chunked.ChunkedSeries[0].Chunks
+	assert.Len(t, chunks, 2)
+	assert.Equal(t, int64(5000), chunks[0].MinTimeMs)
+	assert.Equal(t, int64(124000), chunks[0].MaxTimeMs)
+
+	chunk, err := chunkenc.FromData(chunkenc.EncXOR, chunks[1].Data)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, chunk.NumSamples())
+	it := chunk.Iterator(nil)
+	var ts int64
+	var v float64
+	for it.Next() {
+		ts, v = it.At()
+	}
+	assert.Equal(t, int64(129000), ts)
+	assert.True(t, math.IsInf(v, 1))
+
+	w = read(prompb.ReadRequest_ResponseType(7))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/gin-gonic/gin"
+)
+
+const redacted = "<redacted>"
+
+// secret is a configuration value that is never printed. It's read from an
+// environment variable or, when NAME_FILE is set, from a file that is read
+// again on every reload.
+type secret struct {
+	mu    sync.RWMutex
+	name  string
+	file  string
+	value string
+}
+
+// newSecret reads the secret held by the environment variable name, or by
+// the file its name_FILE variant points to.
+func newSecret(name string) (*secret, error) {
+	s := &secret{name: name, value: os.Getenv(name), file: os.Getenv(name + "_FILE")}
+	if s.file == "" {
+		return s, nil
+	}
+	if s.value != "" {
+		return nil, fmt.Errorf("only one of %s and %s_FILE can be set", name, name)
+	}
+	return s, s.reload()
+}
+
+// Value returns the secret itself, it must only be handed to the code using
+// it, never to a logger.
+func (s *secret) Value() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+// reload reads again the secret file, trimming the trailing newline most
+// tools add.
+func (s *secret) reload() error {
+	if s.file == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return fmt.Errorf("couldn't read %s_FILE: %s", s.name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.value = strings.TrimRight(string(content), "\r\n")
+	return nil
+}
+
+func (s *secret) String() string {
+	if s.Value() == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s *secret) GoString() string { return fmt.Sprintf("secret(%s)", s.String()) }
+
+func (s *secret) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+// reloadSecrets reads again the files of the given secrets.
+func reloadSecrets(secrets ...*secret) error {
+	for _, s := range secrets {
+		if err := s.reload(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// secretFiles returns the files the given secrets are read from.
+func secretFiles(secrets ...*secret) []string {
+	var files []string
+	for _, s := range secrets {
+		if s.file != "" {
+			files = append(files, s.file)
+		}
+	}
+	return files
+}
+
+// sensitiveKafkaProperties are the librdkafka properties holding secrets.
+var sensitiveKafkaProperties = []string{
+	"sasl.password",
+	"sasl.oauthbearer.client.secret",
+	"sasl.oauthbearer.config",
+	"ssl.key.password",
+	"ssl.key.pem",
+	"ssl.keystore.password",
+}
+
+// redactConfigMap returns a printable copy of a kafka configuration, with
+// the values of the sensitive properties redacted.
+func redactConfigMap(cfg kafka.ConfigMap) map[string]string {
+	printable := make(map[string]string, len(cfg))
+	for key, value := range cfg {
+		if contains(sensitiveKafkaProperties, key) || strings.Contains(key, "password") || strings.Contains(key, "secret") {
+			printable[key] = redacted
+			continue
+		}
+		printable[key] = fmt.Sprint(value)
+	}
+	return printable
+}
+
+// configDump returns the effective configuration, with secrets redacted.
+func configDump() (map[string]interface{}, error) {
+	sinks := make(map[string]map[string]string, len(sinkProducers))
+	for name, p := range sinkProducers {
+		kafkaConfig, err := p.config()
+		if err != nil {
+			return nil, err
+		}
+		sinks[name] = redactConfigMap(kafkaConfig)
+	}
+
+	return map[string]interface{}{
+		"sinks": sinks,
+		"env": map[string]interface{}{
+			"KAFKA_BROKER_LIST":                    kafkaBrokerList,
+			"KAFKA_TOPIC":                          kafkaTopic,
+			"KAFKA_COMPRESSION":                    kafkaCompression,
+			"KAFKA_BATCH_NUM_MESSAGES":             kafkaBatchNumMessages,
+			"KAFKA_SSL_CLIENT_CERT_FILE":           kafkaSslClientCertFile,
+			"KAFKA_SSL_CLIENT_KEY_FILE":            kafkaSslClientKeyFile,
+			"KAFKA_SSL_CLIENT_KEY_PASS":            kafkaSslClientKeyPass,
+			"KAFKA_SSL_CA_CERT_FILE":               kafkaSslCACertFile,
+			"KAFKA_SECURITY_PROTOCOL":              kafkaSecurityProtocol,
+			"KAFKA_SASL_MECHANISM":                 kafkaSaslMechanism,
+			"KAFKA_SASL_USERNAME":                  kafkaSaslUsername,
+			"KAFKA_SASL_PASSWORD":                  kafkaSaslPassword,
+			"KAFKA_SASL_OAUTHBEARER_METHOD":        kafkaOAuthBearerMethod,
+			"KAFKA_SASL_OAUTHBEARER_CLIENT_ID":     kafkaOAuthBearerClientID,
+			"KAFKA_SASL_OAUTHBEARER_CLIENT_SECRET": kafkaOAuthBearerClientSecret,
+			"KAFKA_HEADERS":                        kafkaHeaders,
+			"SERIALIZATION_FORMAT":                 fmt.Sprintf("%T", serializer),
+			"BASIC_AUTH_USERNAME":                  basicauthUsername,
+			"BASIC_AUTH_PASSWORD":                  basicauthPassword,
+			"BASIC_AUTH_HTPASSWD_FILE":             htpasswdFile,
+			"BEARER_TOKENS_FILE":                   bearerTokensFile,
+			"AUTHORIZATION_FILE":                   authorizationFile,
+			"TLS_CERT_FILE":                        tlsCertFile,
+			"TLS_CLIENT_CA_FILE":                   tlsClientCAFile,
+			"JWT_JWKS_FILE":                        jwtJWKSFile,
+			"TENANT_HEADER":                        tenantHeader,
+			"TENANT_OVERRIDES_FILE":                tenantOverridesFile,
+			"CONFIG_RELOAD_INTERVAL":               configReloadInterval.String(),
+			"SINKS_FILE":                           sinksFilePath,
+			"REMOTE_WRITE_FORWARD_FILE":            forwardFilePath,
+			"FEDERATE_FILE":                        federateFilePath,
+		},
+	}, nil
+}
+
+// configHandler serves the effective configuration, with secrets redacted.
+func configHandler(c *gin.Context) {
+	dump, err := configDump()
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, dump)
+}
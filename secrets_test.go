@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretFromFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("hunter2\n"), 0600))
+	os.Setenv("TEST_SECRET_FILE", file)
+	defer os.Unsetenv("TEST_SECRET_FILE")
+
+	s, err := newSecret("TEST_SECRET")
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", s.Value())
+
+	assert.Nil(t, ioutil.WriteFile(file, []byte("rotated"), 0600))
+	assert.Nil(t, s.reload())
+	assert.Equal(t, "rotated", s.Value())
+
+	os.Setenv("TEST_SECRET", "plain")
+	defer os.Unsetenv("TEST_SECRET")
+	_, err = newSecret("TEST_SECRET")
+	assert.NotNil(t, err, "the variable and its file variant are exclusive")
+}
+
+func TestSecretIsNeverPrinted(t *testing.T) {
+	s := &secret{name: "TEST_SECRET", value: "hunter2"}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q"} {
+		assert.NotContains(t, fmt.Sprintf(format, s), "hunter2", format)
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"password": s})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(b), "hunter2")
+
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.WithField("password", s).Info("test")
+	assert.NotContains(t, out.String(), "hunter2")
+
+	printable := redactConfigMap(kafka.ConfigMap{"sasl.password": s.Value(), "ssl.key.password": s.Value(), "bootstrap.servers": "kafka:9092"})
+	assert.Equal(t, map[string]string{"sasl.password": redacted, "ssl.key.password": redacted, "bootstrap.servers": "kafka:9092"}, printable)
+}
@@ -16,11 +16,18 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"sort"
 	"strconv"
+	"text/template"
 	"time"
 
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/sirupsen/logrus"
@@ -33,10 +40,112 @@ type Serializer interface {
 	Marshal(metric map[string]interface{}) ([]byte, error)
 }
 
+// Deserializer reads back the samples written by the Serializer of the same
+// format.
+type Deserializer interface {
+	Unmarshal(data []byte) (*Sample, error)
+}
+
+// Sample is the canonical form of a serialized sample. Timestamps have
+// second precision, the labels include the metric name, and staleness markers
+// are read back as plain NaNs.
+type Sample struct {
+	Name      string
+	Labels    map[string]string
+	Timestamp time.Time
+	Value     float64
+}
+
+// sampleRecord builds the record of a sample, as passed to the serializers.
+func sampleRecord(name string, labels map[string]string, sample prompb.Sample) map[string]interface{} {
+	epoch := time.Unix(sample.Timestamp/1000, 0).UTC()
+	return map[string]interface{}{
+		"timestamp": epoch.Format(time.RFC3339),
+		"value":     strconv.FormatFloat(sample.Value, 'f', -1, 64),
+		"name":      name,
+		"labels":    labels,
+	}
+}
+
+// sampleFromRecord is the reverse of sampleRecord, for the records decoded by
+// the deserializers.
+func sampleFromRecord(metric map[string]interface{}) (*Sample, error) {
+	timestamp, _ := metric["timestamp"].(string)
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %s", err)
+	}
+	value, _ := metric["value"].(string)
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value: %s", err)
+	}
+	name, _ := metric["name"].(string)
+
+	labels, ok := metric["labels"].(map[string]interface{})
+	if !ok && metric["labels"] != nil {
+		return nil, fmt.Errorf("invalid labels %T", metric["labels"])
+	}
+	sample := &Sample{Name: name, Labels: make(map[string]string, len(labels)), Timestamp: t.UTC(), Value: v}
+	for k, v := range labels {
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid value of label %q", k)
+		}
+		sample.Labels[k] = value
+	}
+	return sample, nil
+}
+
+// TimeSeries returns the sample as a series with sorted labels.
+func (s *Sample) TimeSeries() *prompb.TimeSeries {
+	ts := &prompb.TimeSeries{
+		Labels:  make([]prompb.Label, 0, len(s.Labels)+1),
+		Samples: []prompb.Sample{{Timestamp: s.Timestamp.UnixNano() / int64(time.Millisecond), Value: s.Value}},
+	}
+	for name, value := range s.Labels {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: name, Value: value})
+	}
+	if _, ok := s.Labels["__name__"]; !ok && s.Name != "" {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: "__name__", Value: s.Name})
+	}
+	sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+	return ts
+}
+
+// record is a serialized sample, along with the headers rendered from the
+// labels of its series.
+type record struct {
+	value   []byte
+	headers []kafka.Header
+}
+
 // Serialize generates the JSON representation for a given Prometheus metric.
 func Serialize(s Serializer, req *prompb.WriteRequest) (map[string][][]byte, error) {
+	records, err := serializeRecords(s, req, "")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][][]byte, len(records))
+	for d, rs := range records {
+		for _, r := range rs {
+			result[d.topic] = append(result[d.topic], r.value)
+		}
+	}
+	return result, nil
+}
+
+// serializeRecords serializes every sample of the request, grouped by sink
+// and topic, applying the topic and match overrides of the tenant and then
+// the routing table.
+func serializeRecords(s Serializer, req *prompb.WriteRequest, tenant string) (map[destination][]record, error) {
 	promBatches.Add(float64(1))
-	result := make(map[string][][]byte)
+	result := make(map[destination][]record)
+
+	overrides := overridesFor(tenant)
+	topicTpl := tenantTopicTemplate(overrides)
+	matchRules := tenantMatch(overrides)
 
 	for _, ts := range req.Timeseries {
 		labels := make(map[string]string, len(ts.Labels))
@@ -45,30 +154,38 @@ func Serialize(s Serializer, req *prompb.WriteRequest) (map[string][][]byte, err
 			labels[string(model.LabelName(l.Name))] = string(model.LabelValue(l.Value))
 		}
 
-		t := topic(labels)
+		name := string(labels["__name__"])
+		if !filterMatch(matchRules, name, labels) {
+			objectsFiltered.Add(float64(len(ts.Samples)))
+			continue
+		}
+
+		dests := routeSeries(name, labels, tenant, topicTpl)
+		headers := labelHeaders(labels)
 
 		for _, sample := range ts.Samples {
-			name := string(labels["__name__"])
-			if !filter(name, labels) {
-				objectsFiltered.Add(float64(1))
-				continue
-			}
+			m := sampleRecord(name, labels, sample)
 
-			epoch := time.Unix(sample.Timestamp/1000, 0).UTC()
-			m := map[string]interface{}{
-				"timestamp": epoch.Format(time.RFC3339),
-				"value":     strconv.FormatFloat(sample.Value, 'f', -1, 64),
-				"name":      name,
-				"labels":    labels,
+			// Every sample is serialized once per format.
+			values := make(map[Serializer][]byte, 1)
+			for _, d := range dests {
+				ds := s
+				if d.serializer != nil {
+					ds = d.serializer
+				}
+				data, ok := values[ds]
+				if !ok {
+					var err error
+					data, err = ds.Marshal(m)
+					if err != nil {
+						serializeFailed.Add(float64(1))
+						logrus.WithError(err).Errorln("couldn't marshal timeseries")
+					}
+					serializeTotal.Add(float64(1))
+					values[ds] = data
+				}
+				result[d] = append(result[d], record{value: data, headers: headers})
 			}
-
-			data, err := s.Marshal(m)
-			if err != nil {
-				serializeFailed.Add(float64(1))
-				logrus.WithError(err).Errorln("couldn't marshal timeseries")
-			}
-			serializeTotal.Add(float64(1))
-			result[t] = append(result[t], data)
 		}
 	}
 
@@ -83,19 +200,67 @@ func (s *JSONSerializer) Marshal(metric map[string]interface{}) ([]byte, error)
 	return json.Marshal(metric)
 }
 
+func (s *JSONSerializer) Unmarshal(data []byte) (*Sample, error) {
+	var metric map[string]interface{}
+	if err := json.Unmarshal(data, &metric); err != nil {
+		return nil, err
+	}
+	return sampleFromRecord(metric)
+}
+
+func (s *JSONSerializer) Format() string {
+	return "json"
+}
+
+func (s *JSONSerializer) ContentType() string {
+	return "application/json"
+}
+
+// SchemaVersion is empty, the JSON layout is not described by a schema.
+func (s *JSONSerializer) SchemaVersion() string {
+	return ""
+}
+
 func NewJSONSerializer() (*JSONSerializer, error) {
 	return &JSONSerializer{}, nil
 }
 
 // AvroJSONSerializer represents a metrics serializer that writes Avro-JSON
 type AvroJSONSerializer struct {
-	codec *goavro.Codec
+	codec         *goavro.Codec
+	schemaVersion string
 }
 
 func (s *AvroJSONSerializer) Marshal(metric map[string]interface{}) ([]byte, error) {
 	return s.codec.TextualFromNative(nil, metric)
 }
 
+func (s *AvroJSONSerializer) Unmarshal(data []byte) (*Sample, error) {
+	native, _, err := s.codec.NativeFromTextual(data)
+	if err != nil {
+		return nil, err
+	}
+	metric, ok := native.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected record %T", native)
+	}
+	return sampleFromRecord(metric)
+}
+
+func (s *AvroJSONSerializer) Format() string {
+	return "avro-json"
+}
+
+func (s *AvroJSONSerializer) ContentType() string {
+	return "application/vnd.apache.avro+json"
+}
+
+// SchemaVersion identifies the Avro schema in use by a fingerprint of its
+// contents.
+func (s *AvroJSONSerializer) SchemaVersion() string {
+	return s.schemaVersion
+}
+
 // NewAvroJSONSerializer builds a new instance of the AvroJSONSerializer
 func NewAvroJSONSerializer(schemaPath string) (*AvroJSONSerializer, error) {
 	schema, err := ioutil.ReadFile(schemaPath)
@@ -110,20 +275,43 @@ func NewAvroJSONSerializer(schemaPath string) (*AvroJSONSerializer, error) {
 		return nil, err
 	}
 
+	fingerprint := sha256.Sum256([]byte(codec.Schema()))
+
 	return &AvroJSONSerializer{
-		codec: codec,
+		codec:         codec,
+		schemaVersion: hex.EncodeToString(fingerprint[:8]),
 	}, nil
 }
 
 func topic(labels map[string]string) string {
+	return renderTopic(topicTemplate, labels, "")
+}
+
+// renderTopic executes a topic template with the labels of a series. The
+// tenant, when known, is available to the template as .tenant, shadowing any
+// label with the same name.
+func renderTopic(tpl *template.Template, labels map[string]string, tenant string) string {
+	data := labels
+	if tenant != "" {
+		data = make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			data[k] = v
+		}
+		data["tenant"] = tenant
+	}
+
 	var buf bytes.Buffer
-	if err := topicTemplate.Execute(&buf, labels); err != nil {
+	if err := tpl.Execute(&buf, data); err != nil {
 		return ""
 	}
 	return buf.String()
 }
 
 func filter(name string, labels map[string]string) bool {
+	return filterMatch(match, name, labels)
+}
+
+func filterMatch(match map[string]*dto.MetricFamily, name string, labels map[string]string) bool {
 	if len(match) == 0 {
 		return true
 	}
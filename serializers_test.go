@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"math"
+	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/stretchr/testify/assert"
@@ -85,6 +88,77 @@ func TestSerializeToAvro(t *testing.T) {
 	}
 }
 
+// randomSample builds a sample with special values and label values with
+// characters that need escaping, as whole seconds are the precision of the
+// serialized timestamps.
+func randomSample(r *rand.Rand) (string, map[string]string, prompb.Sample) {
+	values := []float64{math.Inf(1), math.Inf(-1), math.NaN(), 0, math.Copysign(0, -1), math.MaxFloat64, math.SmallestNonzeroFloat64}
+	runes := []rune("aZ09_:-. \"\\\n{}=,é☃")
+
+	name := fmt.Sprintf("metric_%d", r.Intn(1000))
+	labels := map[string]string{"__name__": name}
+	for i := r.Intn(5); i > 0; i-- {
+		value := make([]rune, r.Intn(10))
+		for j := range value {
+			value[j] = runes[r.Intn(len(runes))]
+		}
+		labels[fmt.Sprintf("label_%d", r.Intn(10))] = string(value)
+	}
+
+	sample := prompb.Sample{Timestamp: r.Int63n(4e12) / 1000 * 1000, Value: r.NormFloat64() * math.Pow(10, float64(r.Intn(40)-20))}
+	if r.Intn(3) == 0 {
+		sample.Value = values[r.Intn(len(values))]
+	}
+	return name, labels, sample
+}
+
+func TestDeserializeRoundTrip(t *testing.T) {
+	for _, format := range []string{"json", "avro-json"} {
+		s, err := newSerializer(format)
+		assert.Nil(t, err)
+		d, err := newDeserializer(format)
+		assert.Nil(t, err)
+
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 500; i++ {
+			name, labels, sample := randomSample(r)
+			data, err := s.Marshal(sampleRecord(name, labels, sample))
+			assert.Nil(t, err)
+
+			decoded, err := d.Unmarshal(data)
+			if !assert.Nil(t, err, string(data)) {
+				continue
+			}
+			assert.Equal(t, name, decoded.Name)
+			assert.Equal(t, labels, decoded.Labels)
+			assert.Equal(t, sample.Timestamp, decoded.Timestamp.UnixNano()/int64(time.Millisecond))
+			if math.IsNaN(sample.Value) {
+				assert.True(t, math.IsNaN(decoded.Value), string(data))
+			} else {
+				assert.Equal(t, math.Float64bits(sample.Value), math.Float64bits(decoded.Value), string(data))
+			}
+
+			ts := decoded.TimeSeries()
+			assert.Equal(t, sample.Timestamp, ts.Samples[0].Timestamp)
+			assert.Len(t, ts.Labels, len(labels))
+		}
+	}
+
+	d, _ := newDeserializer("json")
+	for _, invalid := range []string{
+		`not json`,
+		`{"timestamp":"yesterday","value":"1","name":"up","labels":{}}`,
+		`{"timestamp":"2022-10-01T10:00:00Z","value":"one","name":"up","labels":{}}`,
+		`{"timestamp":"2022-10-01T10:00:00Z","value":"1","name":"up","labels":{"job":1}}`,
+	} {
+		_, err := d.Unmarshal([]byte(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+
+	_, err := newDeserializer("xml")
+	assert.Equal(t, errUnknownFormat, err)
+}
+
 func TestTemplatedTopic(t *testing.T) {
 	var err error
 	topicTemplate, err = parseTopicTemplate("{{ index . \"labelfoo\" | replace \"bar\" \"foo\" | substring 6 -1 }}")
@@ -100,6 +174,36 @@ func TestTemplatedTopic(t *testing.T) {
 	}
 }
 
+func TestTenantOverrides(t *testing.T) {
+	var err error
+	topicTemplate, err = parseTopicTemplate("metrics.{{ .tenant }}")
+	assert.Nil(t, err)
+	overrides, err := parseTenantOverrides([]byte(`
+team-a:
+  topic: 'team-a.{{ index . "__name__" }}'
+team-b:
+  match: ['bar']
+`))
+	assert.Nil(t, err)
+	setTenantOverrides(overrides)
+	defer setTenantOverrides(map[string]*tenantOverrides{})
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	output, err := serializeRecords(serializer, NewWriteRequest(), "team-a")
+	assert.Nil(t, err)
+	assert.Len(t, output[destination{sink: defaultSinkName, topic: "team-a.foo"}], 2)
+
+	output, err = serializeRecords(serializer, NewWriteRequest(), "team-b")
+	assert.Nil(t, err)
+	assert.Len(t, output, 0)
+
+	output, err = serializeRecords(serializer, NewWriteRequest(), "team-c")
+	assert.Nil(t, err)
+	assert.Len(t, output[destination{sink: defaultSinkName, topic: "metrics.team-c"}], 2)
+}
+
 func TestFilter(t *testing.T) {
 	rulesText := `['foo{y="2"}','foo', 'bar{x="1"}',
 'up{x="1",y="2"}', 'baz{key="valu
@@ -0,0 +1,371 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"sync"
+	"text/template"
+
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultSinkName is the name of the sink configured through the KAFKA_*
+// environment variables.
+const defaultSinkName = "default"
+
+// sinkConfig defines a kafka cluster samples can be produced to. Secrets can
+// only be read from files.
+type sinkConfig struct {
+	Brokers              string             `yaml:"brokers"`
+	SecurityProtocol     string             `yaml:"security_protocol"`
+	SSLCACertFile        string             `yaml:"ssl_ca_cert_file"`
+	SSLClientCertFile    string             `yaml:"ssl_client_cert_file"`
+	SSLClientKeyFile     string             `yaml:"ssl_client_key_file"`
+	SSLClientKeyPassFile string             `yaml:"ssl_client_key_pass_file"`
+	SASLMechanism        string             `yaml:"sasl_mechanism"`
+	SASLUsername         string             `yaml:"sasl_username"`
+	SASLPasswordFile     string             `yaml:"sasl_password_file"`
+	OAuthBearer          *oauthBearerConfig `yaml:"oauthbearer"`
+	Config               map[string]string  `yaml:"config"`
+
+	sslClientKeyPass *secret
+	saslPassword     *secret
+}
+
+// route sends the samples of the series matching its rules to a set of sinks.
+// Routes without match rules apply to every series.
+type route struct {
+	Match   []string       `yaml:"match"`
+	Sinks   []string       `yaml:"sinks"`
+	Topic   string         `yaml:"topic"`
+	Outputs []*routeOutput `yaml:"outputs"`
+
+	match         map[string]*dto.MetricFamily
+	topicTemplate *template.Template
+}
+
+// routeOutput is an additional output of a route, usually written in another
+// format to mirror the traffic during migrations. Its failures don't fail the
+// request unless it is required.
+type routeOutput struct {
+	Sinks    []string `yaml:"sinks"`
+	Topic    string   `yaml:"topic"`
+	Format   string   `yaml:"format"`
+	Required bool     `yaml:"required"`
+
+	topicTemplate *template.Template
+	serializer    Serializer
+}
+
+// sinksFile is the layout of SINKS_FILE.
+type sinksFile struct {
+	Sinks    map[string]*sinkConfig     `yaml:"sinks"`
+	Routes   []*route                   `yaml:"routes"`
+	Failover map[string]*failoverConfig `yaml:"failover"`
+}
+
+// destination is a topic of a sink, written in the format of a serializer.
+// A nil serializer stands for the one of SERIALIZATION_FORMAT. Records of
+// optional destinations may be lost without failing the request.
+type destination struct {
+	sink       string
+	topic      string
+	serializer Serializer
+	optional   bool
+}
+
+var (
+	// sinkProducers holds the producer of every sink, it is only written on
+	// startup.
+	sinkProducers = map[string]*reloadableProducer{}
+
+	routesMu sync.RWMutex
+	routes   []*route
+)
+
+// envSinkConfig returns the definition of the default sink.
+func envSinkConfig() *sinkConfig {
+	return &sinkConfig{
+		Brokers:           kafkaBrokerList,
+		SecurityProtocol:  kafkaSecurityProtocol,
+		SSLCACertFile:     kafkaSslCACertFile,
+		SSLClientCertFile: kafkaSslClientCertFile,
+		SSLClientKeyFile:  kafkaSslClientKeyFile,
+		SASLMechanism:     kafkaSaslMechanism,
+		SASLUsername:      kafkaSaslUsername,
+		sslClientKeyPass:  kafkaSslClientKeyPass,
+		saslPassword:      kafkaSaslPassword,
+		OAuthBearer:       envOAuthBearerConfig(),
+	}
+}
+
+func loadSinks(path string) (*sinksFile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSinks(content)
+}
+
+func parseSinks(content []byte) (*sinksFile, error) {
+	var file sinksFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, err
+	}
+
+	for name, s := range file.Sinks {
+		if name == defaultSinkName {
+			return nil, fmt.Errorf("sink name %q is reserved for the sink defined by the environment", name)
+		}
+		if s == nil || s.Brokers == "" {
+			return nil, fmt.Errorf("sink %q has no brokers", name)
+		}
+		s.sslClientKeyPass = &secret{name: "ssl_client_key_pass of sink " + name, file: s.SSLClientKeyPassFile}
+		s.saslPassword = &secret{name: "sasl_password of sink " + name, file: s.SASLPasswordFile}
+		if err := reloadSecrets(s.sslClientKeyPass, s.saslPassword); err != nil {
+			return nil, err
+		}
+		if o := s.OAuthBearer; o != nil {
+			if o.Method != "" && o.Method != "default" && o.Method != "oidc" {
+				return nil, fmt.Errorf("invalid oauthbearer method %q of sink %q, must be default or oidc", o.Method, name)
+			}
+			o.clientSecret = &secret{name: "oauthbearer client_secret of sink " + name, file: o.ClientSecretFile}
+			if err := reloadSecrets(o.clientSecret); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := validateFailovers(file.Failover, file.Sinks); err != nil {
+		return nil, err
+	}
+
+	// Outputs in the same format share their serializer, so every sample is
+	// serialized once per format.
+	serializers := map[string]Serializer{}
+
+	checkSinks := func(i int, sinks []string) ([]string, error) {
+		for _, name := range sinks {
+			if _, ok := file.Sinks[name]; !ok && name != defaultSinkName {
+				return nil, fmt.Errorf("route %d uses unknown sink %q", i, name)
+			}
+		}
+		if len(sinks) == 0 {
+			sinks = []string{defaultSinkName}
+		}
+		return sinks, nil
+	}
+
+	for i, r := range file.Routes {
+		if r == nil {
+			return nil, fmt.Errorf("route %d is empty", i)
+		}
+		var err error
+		if r.Sinks, err = checkSinks(i, r.Sinks); err != nil {
+			return nil, err
+		}
+		if r.Topic != "" {
+			if r.topicTemplate, err = parseTopicTemplate(r.Topic); err != nil {
+				return nil, fmt.Errorf("couldn't parse topic template of route %d: %s", i, err)
+			}
+		}
+		for j, o := range r.Outputs {
+			if o == nil || o.Topic == "" {
+				return nil, fmt.Errorf("output %d of route %d has no topic", j, i)
+			}
+			if o.Sinks, err = checkSinks(i, o.Sinks); err != nil {
+				return nil, err
+			}
+			if o.topicTemplate, err = parseTopicTemplate(o.Topic); err != nil {
+				return nil, fmt.Errorf("couldn't parse topic template of output %d of route %d: %s", j, i, err)
+			}
+			// Outputs in the primary format leave their serializer unset.
+			format := o.Format
+			if d, ok := serializer.(describer); ok && d.Format() == format {
+				format = ""
+			}
+			if format != "" {
+				if _, ok := serializers[format]; !ok {
+					if serializers[format], err = newSerializer(format); err != nil {
+						return nil, fmt.Errorf("invalid format of output %d of route %d: %s", j, i, err)
+					}
+				}
+				o.serializer = serializers[format]
+			}
+		}
+		m, err := matchRulesToMetricFamilies(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse match rules of route %d: %s", i, err)
+		}
+		r.match = m
+	}
+	return &file, nil
+}
+
+// startSinks creates the producers of the default sink and of the sinks of
+// SINKS_FILE, and registers the reload of their files.
+func startSinks() error {
+	sinks := map[string]*sinkConfig{defaultSinkName: envSinkConfig()}
+
+	file := &sinksFile{}
+	if sinksFilePath != "" {
+		var err error
+		if file, err = loadSinks(sinksFilePath); err != nil {
+			return err
+		}
+		for name, s := range file.Sinks {
+			sinks[name] = s
+		}
+		setRoutes(file.Routes)
+
+		// Routes can be changed on the fly, changing the sinks requires a
+		// restart.
+		registerReload("sinks", []string{sinksFilePath}, func() error {
+			return reloadRoutes(sinksFilePath, file)
+		})
+	}
+
+	for _, name := range sortedSinkNames(sinks) {
+		s := sinks[name]
+		producer, err := newReloadableProducer(name, s.configMap, s.OAuthBearer)
+		if err != nil {
+			return fmt.Errorf("couldn't create the producer of sink %q: %s", name, err)
+		}
+		sinkProducers[name] = producer
+
+		if files := s.files(); len(files) > 0 {
+			registerReload("kafka-"+name, files, func() error {
+				if err := reloadSecrets(s.secrets()...); err != nil {
+					return err
+				}
+				return producer.reload()
+			})
+		}
+	}
+
+	for name, config := range file.Failover {
+		f := newFailover(*config, sinkProducers[name], sinkProducers[config.Standby])
+		failovers[name] = f
+		go f.run()
+	}
+	return nil
+}
+
+// reloadRoutes applies the routes of a sinks file, as long as its sinks are
+// the same as the running ones.
+func reloadRoutes(path string, running *sinksFile) error {
+	reloaded, err := loadSinks(path)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(sinkDefinitions(reloaded.Sinks), sinkDefinitions(running.Sinks)) || !reflect.DeepEqual(reloaded.Failover, running.Failover) {
+		return fmt.Errorf("the sink definitions changed, restart to apply them")
+	}
+	setRoutes(reloaded.Routes)
+	return nil
+}
+
+// sinkDefinitions strips the loaded secrets of the sinks, so definitions can
+// be compared.
+func sinkDefinitions(sinks map[string]*sinkConfig) map[string]sinkConfig {
+	definitions := make(map[string]sinkConfig, len(sinks))
+	for name, s := range sinks {
+		d := *s
+		d.sslClientKeyPass, d.saslPassword = nil, nil
+		if s.OAuthBearer != nil {
+			o := *s.OAuthBearer
+			o.clientSecret = nil
+			d.OAuthBearer = &o
+		}
+		definitions[name] = d
+	}
+	return definitions
+}
+
+func sortedSinkNames(sinks map[string]*sinkConfig) []string {
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func setRoutes(r []*route) {
+	routesMu.Lock()
+	defer routesMu.Unlock()
+	routes = r
+}
+
+// routeSeries returns the destinations of the samples of a series. A series
+// matching no route goes to the topic of the default sink.
+func routeSeries(name string, labels map[string]string, tenant string, topicTpl *template.Template) []destination {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+
+	var dests []destination
+	for _, r := range routes {
+		if !filterMatch(r.match, name, labels) {
+			continue
+		}
+		tpl := topicTpl
+		if r.topicTemplate != nil {
+			tpl = r.topicTemplate
+		}
+		t := renderTopic(tpl, labels, tenant)
+		for _, sink := range r.Sinks {
+			dests = appendDestination(dests, destination{sink: sink, topic: t})
+		}
+		for _, o := range r.Outputs {
+			t := renderTopic(o.topicTemplate, labels, tenant)
+			for _, sink := range o.Sinks {
+				dests = appendDestination(dests, destination{sink: sink, topic: t, serializer: o.serializer, optional: !o.Required})
+			}
+		}
+	}
+	if len(dests) == 0 {
+		dests = append(dests, destination{sink: defaultSinkName, topic: renderTopic(topicTpl, labels, tenant)})
+	}
+	return dests
+}
+
+// appendDestination adds a destination once, a destination both optional and
+// required is required.
+func appendDestination(dests []destination, d destination) []destination {
+	for i, existing := range dests {
+		if existing.sink == d.sink && existing.topic == d.topic && existing.serializer == d.serializer {
+			dests[i].optional = existing.optional && d.optional
+			return dests
+		}
+	}
+	return append(dests, d)
+}
+
+// sinksHealth returns the health of every sink, as reported by /healthz.
+func sinksHealth() map[string]string {
+	health := make(map[string]string, len(sinkProducers))
+	for name, p := range sinkProducers {
+		health[name] = "UP"
+		if !p.healthy() {
+			health[name] = "DOWN"
+		}
+	}
+	return health
+}
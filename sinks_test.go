@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteSeries(t *testing.T) {
+	file, err := parseSinks([]byte(`
+sinks:
+  compliance:
+    brokers: compliance:9092
+    security_protocol: sasl_ssl
+    sasl_mechanism: OAUTHBEARER
+    oauthbearer:
+      method: oidc
+      client_id: adapter
+      token_endpoint_url: https://idp/token
+      scope: kafka
+  eu:
+    brokers: kafka-eu:9092
+    config:
+      linger.ms: "50"
+routes:
+  - match: ['billing_total']
+    sinks: [compliance, default]
+    topic: billing
+  - match: ['up{region="eu"}']
+    sinks: [eu]
+`))
+	assert.Nil(t, err)
+	setRoutes(file.Routes)
+	defer setRoutes(nil)
+
+	tpl, err := parseTopicTemplate("metrics")
+	assert.Nil(t, err)
+
+	assert.Equal(t, []destination{{sink: "compliance", topic: "billing"}, {sink: defaultSinkName, topic: "billing"}},
+		routeSeries("billing_total", map[string]string{"__name__": "billing_total"}, "", tpl))
+	assert.Equal(t, []destination{{sink: "eu", topic: "metrics"}},
+		routeSeries("up", map[string]string{"__name__": "up", "region": "eu"}, "", tpl))
+	assert.Equal(t, []destination{{sink: defaultSinkName, topic: "metrics"}},
+		routeSeries("up", map[string]string{"__name__": "up", "region": "us"}, "", tpl), "unrouted series go to the default sink")
+
+	kafkaConfig, err := file.Sinks["eu"].configMap()
+	assert.Nil(t, err)
+	assert.Equal(t, "kafka-eu:9092", kafkaConfig["bootstrap.servers"])
+	assert.Equal(t, "50", kafkaConfig["linger.ms"])
+
+	// Every sink has its own oauthbearer settings.
+	kafkaConfig, err = file.Sinks["compliance"].configMap()
+	assert.Nil(t, err)
+	assert.Equal(t, "OAUTHBEARER", kafkaConfig["sasl.mechanism"])
+	assert.Equal(t, "adapter", kafkaConfig["sasl.oauthbearer.client.id"])
+	assert.Equal(t, "https://idp/token", kafkaConfig["sasl.oauthbearer.token.endpoint.url"])
+	assert.Equal(t, "kafka", kafkaConfig["sasl.oauthbearer.scope"])
+
+	_, err = parseSinks([]byte(`
+routes:
+  - sinks: [missing]
+`))
+	assert.NotNil(t, err, "routes can only use defined sinks")
+
+	_, err = parseSinks([]byte(`
+sinks:
+  eu:
+    brokers: kafka-eu:9092
+    oauthbearer: {method: password}
+`))
+	assert.NotNil(t, err, "oauthbearer methods are validated")
+}
+
+func TestTeeOutputs(t *testing.T) {
+	file, err := parseSinks([]byte(`
+routes:
+  - topic: metrics
+    outputs:
+      - topic: metrics-avro
+        format: avro-json
+      - topic: metrics-copy
+        format: json
+        required: true
+`))
+	assert.Nil(t, err)
+	setRoutes(file.Routes)
+	defer setRoutes(nil)
+
+	s, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	output, err := serializeRecords(s, NewWriteRequest(), "")
+	assert.Nil(t, err)
+	assert.Len(t, output, 3)
+
+	avro := file.Routes[0].Outputs[0].serializer
+	assert.IsType(t, &AvroJSONSerializer{}, avro)
+	assert.Nil(t, file.Routes[0].Outputs[1].serializer, "outputs in the primary format reuse its serializer")
+
+	primary := output[destination{sink: defaultSinkName, topic: "metrics"}]
+	mirrored := output[destination{sink: defaultSinkName, topic: "metrics-avro", serializer: avro, optional: true}]
+	assert.Len(t, primary, 2)
+	assert.Len(t, mirrored, 2)
+	assert.NotEqual(t, primary[0].value, mirrored[0].value)
+	assert.Equal(t, primary, output[destination{sink: defaultSinkName, topic: "metrics-copy"}])
+}
+
+func TestReloadRoutes(t *testing.T) {
+	dir := t.TempDir()
+	path, password := filepath.Join(dir, "sinks.yaml"), filepath.Join(dir, "password")
+	writeSinks := func(brokers, topic string) {
+		assert.Nil(t, ioutil.WriteFile(path, []byte(fmt.Sprintf(`
+sinks:
+  eu:
+    brokers: %s
+    security_protocol: sasl_ssl
+    sasl_mechanism: PLAIN
+    sasl_username: adapter
+    sasl_password_file: %s
+routes:
+  - sinks: [eu]
+    topic: %s
+`, brokers, password, topic)), 0600))
+	}
+	assert.Nil(t, ioutil.WriteFile(password, []byte("secret"), 0600))
+	writeSinks("kafka-eu:9092", "metrics")
+	running, err := loadSinks(path)
+	assert.Nil(t, err)
+	defer setRoutes(nil)
+
+	// Routes and secrets can change, the secrets being reloaded along with
+	// the producers.
+	assert.Nil(t, ioutil.WriteFile(password, []byte("rotated"), 0600))
+	writeSinks("kafka-eu:9092", "metrics-eu")
+	assert.Nil(t, reloadRoutes(path, running))
+	assert.Equal(t, "metrics-eu", routes[0].Topic)
+
+	writeSinks("kafka-eu-2:9092", "metrics-eu-2")
+	assert.NotNil(t, reloadRoutes(path, running), "changing the sinks requires a restart")
+	assert.Equal(t, "metrics-eu", routes[0].Topic, "rejected reloads keep the current routes")
+}
@@ -0,0 +1,396 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/sirupsen/logrus"
+)
+
+// Output formats of the tail subcommand.
+const (
+	tailTable      = "table"
+	tailExposition = "exposition"
+	tailNDJSON     = "ndjson"
+)
+
+// tailOptions configures the tail subcommand.
+type tailOptions struct {
+	topics   []string
+	since    time.Time
+	matchers []*labels.Matcher
+	format   string
+	output   string
+	limit    int
+}
+
+func parseTailOptions(args []string, now time.Time) (*tailOptions, error) {
+	opts := &tailOptions{}
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	topics := fs.String("topics", "", "comma separated list of the topics to read")
+	from := fs.String("from", "latest", "where to start reading: latest, an RFC3339 time or a duration ago like 15m")
+	selector := fs.String("selector", "", `series selector the samples must match, like up{job=~"api|web"}`)
+	fs.StringVar(&opts.format, "format", "", "format of the records without format header, defaults to SERIALIZATION_FORMAT")
+	fs.StringVar(&opts.output, "output", tailTable, "output format: table, exposition or ndjson")
+	fs.IntVar(&opts.limit, "limit", 0, "number of samples printed before exiting, 0 doesn't limit them")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	for _, topic := range strings.Split(*topics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			opts.topics = append(opts.topics, topic)
+		}
+	}
+	if len(opts.topics) == 0 {
+		return nil, errors.New("no topics to read")
+	}
+
+	if *from != "latest" {
+		if t, err := time.Parse(time.RFC3339, *from); err == nil {
+			opts.since = t
+		} else if d, err := time.ParseDuration(*from); err == nil && d > 0 {
+			opts.since = now.Add(-d)
+		} else {
+			return nil, fmt.Errorf("invalid start %q, it must be latest, an RFC3339 time or a positive duration", *from)
+		}
+	}
+
+	var err error
+	if opts.matchers, err = parseSeriesSelector(*selector); err != nil {
+		return nil, fmt.Errorf("invalid selector: %s", err)
+	}
+
+	switch opts.output {
+	case tailTable, tailExposition, tailNDJSON:
+	default:
+		return nil, fmt.Errorf("unknown output format %q", opts.output)
+	}
+	return opts, nil
+}
+
+// parseSeriesSelector parses a PromQL series selector, an optional metric
+// name followed by optional label matchers between braces.
+func parseSeriesSelector(selector string) ([]*labels.Matcher, error) {
+	s := strings.TrimSpace(selector)
+	var matchers []*labels.Matcher
+
+	name := s
+	if i := strings.IndexByte(s, '{'); i >= 0 {
+		name = strings.TrimSpace(s[:i])
+		s = s[i:]
+	} else {
+		s = ""
+	}
+	if name != "" {
+		if !isMetricName(name) {
+			return nil, fmt.Errorf("invalid metric name %q", name)
+		}
+		m, _ := labels.NewMatcher(labels.MatchEqual, labels.MetricName, name)
+		matchers = append(matchers, m)
+	}
+	if s == "" {
+		return matchers, nil
+	}
+
+	if !strings.HasSuffix(s, "}") {
+		return nil, errors.New("unclosed braces")
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	for s != "" {
+		i := strings.IndexFunc(s, func(r rune) bool { return !isLabelNameRune(r) })
+		if i <= 0 {
+			return nil, fmt.Errorf("expected a label name at %q", s)
+		}
+		name, s = s[:i], strings.TrimSpace(s[i:])
+
+		var t labels.MatchType
+		switch {
+		case strings.HasPrefix(s, "=~"):
+			t, s = labels.MatchRegexp, s[2:]
+		case strings.HasPrefix(s, "!~"):
+			t, s = labels.MatchNotRegexp, s[2:]
+		case strings.HasPrefix(s, "!="):
+			t, s = labels.MatchNotEqual, s[2:]
+		case strings.HasPrefix(s, "="):
+			t, s = labels.MatchEqual, s[1:]
+		default:
+			return nil, fmt.Errorf("expected a matcher operator after %q", name)
+		}
+
+		s = strings.TrimSpace(s)
+		quoted, err := quotedPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of label %q: %s", name, err)
+		}
+		value, err := unquoteLabelValue(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of label %q: %s", name, err)
+		}
+		m, err := labels.NewMatcher(t, name, value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+
+		s = strings.TrimSpace(s[len(quoted):])
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+		} else if s != "" {
+			return nil, fmt.Errorf("expected a comma at %q", s)
+		}
+	}
+	return matchers, nil
+}
+
+func isLabelNameRune(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+func isMetricName(name string) bool {
+	for i, r := range name {
+		if !(isLabelNameRune(r) || r == ':') || (i == 0 && unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// quotedPrefix returns the string literal at the start of s, quoted with
+// double, single quotes or backticks.
+func quotedPrefix(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("missing value")
+	}
+	quote := s[0]
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", errors.New("value is not quoted")
+	}
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quote != '`':
+			i++
+		case s[i] == quote:
+			return s[:i+1], nil
+		}
+	}
+	return "", errors.New("unterminated quoted value")
+}
+
+// unquoteLabelValue unquotes a string literal, which may be single quoted
+// as in PromQL.
+func unquoteLabelValue(quoted string) (string, error) {
+	if quoted[0] != '\'' {
+		return strconv.Unquote(quoted)
+	}
+	inner := strings.Replace(quoted[1:len(quoted)-1], `\'`, `'`, -1)
+	return strconv.Unquote(`"` + strings.Replace(inner, `"`, `\"`, -1) + `"`)
+}
+
+// tailRecord is a decoded record, along with its position in the topic.
+type tailRecord struct {
+	topic     string
+	partition int32
+	offset    kafka.Offset
+	headers   []kafka.Header
+	sample    *Sample
+}
+
+// tailTableRow lays out the columns of the table output. Records are
+// printed as they arrive, so the columns have fixed widths instead of
+// fitting their contents.
+const tailTableRow = "%-24s %9s %12s %-20s %-60s %-12s %s\n"
+
+// tailPrinter writes the records in one of the output formats.
+type tailPrinter struct {
+	output string
+	w      io.Writer
+}
+
+func newTailPrinter(output string, w io.Writer) *tailPrinter {
+	if output == tailTable {
+		fmt.Fprintf(w, tailTableRow, "TOPIC", "PARTITION", "OFFSET", "TIMESTAMP", "SERIES", "VALUE", "HEADERS")
+	}
+	return &tailPrinter{output: output, w: w}
+}
+
+func (p *tailPrinter) print(r *tailRecord) error {
+	value := strconv.FormatFloat(r.sample.Value, 'f', -1, 64)
+	switch p.output {
+	case tailExposition:
+		comment := fmt.Sprintf("# topic=%s partition=%d offset=%d", r.topic, r.partition, r.offset)
+		for _, pair := range headerPairs(r.headers) {
+			comment += " " + pair
+		}
+		_, err := fmt.Fprintf(p.w, "%s\n%s %s %d\n", comment, formatSeries(r.sample), value, r.sample.Timestamp.UnixNano()/int64(time.Millisecond))
+		return err
+	case tailNDJSON:
+		headers := make(map[string]string, len(r.headers))
+		for _, h := range r.headers {
+			headers[h.Key] = string(h.Value)
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"topic":     r.topic,
+			"partition": r.partition,
+			"offset":    int64(r.offset),
+			"headers":   headers,
+			"timestamp": r.sample.Timestamp.Format(time.RFC3339),
+			"name":      r.sample.Name,
+			"labels":    r.sample.Labels,
+			"value":     value,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(p.w, "%s\n", data)
+		return err
+	default:
+		_, err := fmt.Fprintf(p.w, tailTableRow, r.topic, strconv.Itoa(int(r.partition)), r.offset.String(),
+			r.sample.Timestamp.Format(time.RFC3339), formatSeries(r.sample), value, strings.Join(headerPairs(r.headers), ","))
+		return err
+	}
+}
+
+// formatSeries writes the series of a sample in exposition format.
+func formatSeries(s *Sample) string {
+	names := make([]string, 0, len(s.Labels))
+	for name := range s.Labels {
+		if name != labels.MetricName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	name := s.Name
+	if name == "" {
+		name = s.Labels[labels.MetricName]
+	}
+	if len(names) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(names))
+	for _, n := range names {
+		pairs = append(pairs, n+"="+strconv.Quote(s.Labels[n]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// headerPairs writes the headers of a record as key=value pairs.
+func headerPairs(headers []kafka.Header) []string {
+	pairs := make([]string, 0, len(headers))
+	for _, h := range headers {
+		pairs = append(pairs, h.Key+"="+string(h.Value))
+	}
+	return pairs
+}
+
+// runTail prints the samples landing in topics, or already in them since a
+// time, that match a series selector.
+func runTail(args []string) error {
+	// The samples go to the standard output, the logs don't.
+	logrus.SetOutput(os.Stderr)
+
+	opts, err := parseTailOptions(args, time.Now())
+	if err != nil {
+		return err
+	}
+	if opts.format == "" {
+		opts.format = serializationFormat()
+	}
+	decoder, err := newRecordDecoder(opts.format)
+	if err != nil {
+		return err
+	}
+
+	sink := envSinkConfig()
+	config, err := sink.consumerConfigMap("prometheus-kafka-adapter-tail-" + instanceID)
+	if err != nil {
+		return err
+	}
+	consumer, err := kafka.NewConsumer(&config)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+	refresher := newOAuthBearerRefresher(defaultSinkName, sink.OAuthBearer, consumer)
+	defer refresher.close()
+
+	partitions, err := partitionsSince(consumer, opts.topics, opts.since)
+	if err != nil {
+		return err
+	}
+	if err := consumer.Assign(partitions); err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	printer := newTailPrinter(opts.output, os.Stdout)
+	printed := 0
+	for opts.limit == 0 || printed < opts.limit {
+		select {
+		case <-signals:
+			return nil
+		default:
+		}
+
+		switch ev := consumer.Poll(100).(type) {
+		case *kafka.Message:
+			_, sample, err := decoder.decode(ev)
+			if err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{"partition": ev.TopicPartition.Partition, "offset": ev.TopicPartition.Offset}).Warn("skipping undecodable record")
+				continue
+			}
+			if !matchLabels(opts.matchers, sample.TimeSeries().Labels) {
+				continue
+			}
+			err = printer.print(&tailRecord{
+				topic:     *ev.TopicPartition.Topic,
+				partition: ev.TopicPartition.Partition,
+				offset:    ev.TopicPartition.Offset,
+				headers:   ev.Headers,
+				sample:    sample,
+			})
+			if err != nil {
+				return err
+			}
+			printed++
+		case kafka.OAuthBearerTokenRefresh:
+			refresher.refresh()
+		case kafka.Error:
+			if ev.IsFatal() {
+				return ev
+			}
+			logrus.WithError(ev).Warn("kafka consumer error")
+		}
+	}
+	return nil
+}
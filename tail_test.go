@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSeriesSelector(t *testing.T) {
+	matchers, err := parseSeriesSelector(`http_requests_total{job=~"api|web", code!="200",path='/a\'b', le=` + "`+Inf`" + `,}`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		`__name__="http_requests_total"`,
+		`job=~"api|web"`,
+		`code!="200"`,
+		`path="/a'b"`,
+		`le="+Inf"`,
+	}, matcherStrings(matchers))
+
+	matchers, err = parseSeriesSelector(`{__name__!~"go_.*", instance="a{1}"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{`__name__!~"go_.*"`, `instance="a{1}"`}, matcherStrings(matchers))
+
+	matchers, err = parseSeriesSelector(" up ")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{`__name__="up"`}, matcherStrings(matchers))
+
+	matchers, err = parseSeriesSelector("")
+	assert.Nil(t, err)
+	assert.Empty(t, matchers)
+
+	for _, invalid := range []string{
+		`0up`,
+		`up{job="api"`,
+		`up{job}`,
+		`up{job=api}`,
+		`up{job="api" code="200"}`,
+		`up{job=~"("}`,
+		`up{job="api}`,
+	} {
+		_, err := parseSeriesSelector(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func matcherStrings(matchers []*labels.Matcher) []string {
+	var result []string
+	for _, m := range matchers {
+		result = append(result, m.String())
+	}
+	return result
+}
+
+func TestParseTailOptions(t *testing.T) {
+	now := time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)
+
+	opts, err := parseTailOptions([]string{"-topics", "metrics"}, now)
+	assert.Nil(t, err)
+	assert.True(t, opts.since.IsZero())
+	assert.Equal(t, tailTable, opts.output)
+
+	opts, err = parseTailOptions([]string{"-topics", "metrics", "-from", "15m", "-output", "ndjson"}, now)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(-15*time.Minute), opts.since)
+
+	opts, err = parseTailOptions([]string{"-topics", "metrics", "-from", "2022-09-30T00:00:00Z"}, now)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2022, 9, 30, 0, 0, 0, 0, time.UTC), opts.since)
+
+	for _, invalid := range [][]string{
+		{},
+		{"-topics", "metrics", "-from", "yesterday"},
+		{"-topics", "metrics", "-from", "-5m"},
+		{"-topics", "metrics", "-output", "yaml"},
+		{"-topics", "metrics", "-selector", "up{"},
+	} {
+		_, err := parseTailOptions(invalid, now)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestTailPrinter(t *testing.T) {
+	record := &tailRecord{
+		topic:     "metrics",
+		partition: 2,
+		offset:    42,
+		headers:   []kafka.Header{{Key: "tenant", Value: []byte("team-a")}, {Key: "format", Value: []byte("json")}},
+		sample: &Sample{
+			Name:      "up",
+			Labels:    map[string]string{"__name__": "up", "job": "api", "path": `say "hi"`},
+			Timestamp: time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC),
+			Value:     math.Inf(1),
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, newTailPrinter(tailExposition, &buf).print(record))
+	assert.Equal(t, "# topic=metrics partition=2 offset=42 tenant=team-a format=json\n"+
+		`up{job="api",path="say \"hi\""} +Inf 1664618400000`+"\n", buf.String())
+
+	buf.Reset()
+	assert.Nil(t, newTailPrinter(tailNDJSON, &buf).print(record))
+	assert.JSONEq(t, `{"topic":"metrics","partition":2,"offset":42,"headers":{"tenant":"team-a","format":"json"},
+		"timestamp":"2022-10-01T10:00:00Z","name":"up","labels":{"__name__":"up","job":"api","path":"say \"hi\""},"value":"+Inf"}`, buf.String())
+
+	buf.Reset()
+	assert.Nil(t, newTailPrinter(tailTable, &buf).print(record))
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	assert.Len(t, lines, 2)
+	assert.Regexp(t, `^TOPIC +PARTITION +OFFSET +TIMESTAMP +SERIES +VALUE +HEADERS$`, string(lines[0]))
+	assert.Regexp(t, `^metrics +2 +42 +2022-10-01T10:00:00Z +up\{job="api",path="say \\"hi\\""\} +\+Inf +tenant=team-a,format=json$`, string(lines[1]))
+}
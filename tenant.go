@@ -0,0 +1,185 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v2"
+)
+
+const maxTenantLength = 150
+
+var errMissingTenant = errors.New("no tenant found in request")
+
+// tenantOverrides holds the settings that can be overridden per tenant. Unset
+// fields fall back to the global configuration.
+type tenantOverrides struct {
+	Topic        string   `yaml:"topic"`
+	Match        []string `yaml:"match"`
+	tenantLimits `yaml:",inline"`
+
+	topicTemplate *template.Template
+	match         map[string]*dto.MetricFamily
+}
+
+// forbiddenTenantError is returned when the credentials of a request don't
+// allow writing as its tenant.
+type forbiddenTenantError struct {
+	principal string
+	tenant    string
+}
+
+func (e *forbiddenTenantError) Error() string {
+	return fmt.Sprintf("principal %q is not allowed to write as tenant %q", e.principal, e.tenant)
+}
+
+// tenantFromRequest extracts the tenant of a request. Authenticated requests
+// default to the tenant asserted by the credentials or else to the principal,
+// and may only name another tenant in the tenant header when the
+// authorization file allows it. Other requests take it from the tenant
+// header, falling back to the basic auth user and then to the default tenant.
+func tenantFromRequest(c *gin.Context) (string, error) {
+	tenant := c.GetHeader(tenantHeader)
+	if id := requestIdentity(c); id != nil {
+		if tenant == "" {
+			tenant = id.tenant
+		}
+		if tenant == "" {
+			tenant = id.principal
+		}
+		if !requestAuth.authorizeTenant(id, tenant) {
+			return "", &forbiddenTenantError{principal: id.principal, tenant: tenant}
+		}
+	}
+	if tenant == "" {
+		tenant, _, _ = c.Request.BasicAuth()
+	}
+	if tenant == "" {
+		if tenantRequired {
+			return "", errMissingTenant
+		}
+		tenant = defaultTenant
+	}
+	if tenant == "" {
+		return "", nil
+	}
+
+	if err := validateTenant(tenant); err != nil {
+		return "", err
+	}
+	return tenant, nil
+}
+
+// validateTenant ensures a tenant ID is safe to be used in topic names and
+// record headers.
+func validateTenant(tenant string) error {
+	if len(tenant) > maxTenantLength {
+		return fmt.Errorf("tenant ID is too long: max %d characters", maxTenantLength)
+	}
+	if tenant == "." || tenant == ".." {
+		return fmt.Errorf("tenant ID %q is not allowed", tenant)
+	}
+	for _, r := range tenant {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '!', r == '-', r == '_', r == '.', r == '*', r == '\'', r == '(', r == ')':
+		default:
+			return fmt.Errorf("tenant ID %q contains unsupported character %q", tenant, r)
+		}
+	}
+	return nil
+}
+
+var tenantConfigMu sync.RWMutex
+
+// overridesFor returns the overrides of a tenant, nil if there are none.
+func overridesFor(tenant string) *tenantOverrides {
+	if tenant == "" {
+		return nil
+	}
+	tenantConfigMu.RLock()
+	defer tenantConfigMu.RUnlock()
+	return tenantConfig[tenant]
+}
+
+// setTenantOverrides replaces the overrides of all the tenants.
+func setTenantOverrides(overrides map[string]*tenantOverrides) {
+	tenantConfigMu.Lock()
+	defer tenantConfigMu.Unlock()
+	tenantConfig = overrides
+}
+
+// tenantTopicTemplate returns the topic template to be used for a tenant.
+func tenantTopicTemplate(o *tenantOverrides) *template.Template {
+	if o != nil && o.topicTemplate != nil {
+		return o.topicTemplate
+	}
+	return topicTemplate
+}
+
+// tenantMatch returns the match rules to be used for a tenant.
+func tenantMatch(o *tenantOverrides) map[string]*dto.MetricFamily {
+	if o != nil && o.match != nil {
+		return o.match
+	}
+	return match
+}
+
+func loadTenantOverrides(path string) (map[string]*tenantOverrides, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseTenantOverrides(content)
+}
+
+func parseTenantOverrides(content []byte) (map[string]*tenantOverrides, error) {
+	var overrides map[string]*tenantOverrides
+	if err := yaml.UnmarshalStrict(content, &overrides); err != nil {
+		return nil, err
+	}
+
+	for tenant, o := range overrides {
+		if o == nil {
+			delete(overrides, tenant)
+			continue
+		}
+		if err := validateTenant(tenant); err != nil {
+			return nil, err
+		}
+		if o.Topic != "" {
+			t, err := parseTopicTemplate(o.Topic)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't parse topic template for tenant %q: %s", tenant, err)
+			}
+			o.topicTemplate = t
+		}
+		if o.Match != nil {
+			m, err := matchRulesToMetricFamilies(o.Match)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't parse match rules for tenant %q: %s", tenant, err)
+			}
+			o.match = m
+		}
+	}
+	return overrides, nil
+}
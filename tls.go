@@ -0,0 +1,199 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Client certificate verification modes, as accepted by TLS_CLIENT_AUTH.
+const (
+	clientAuthRequire       = "require-and-verify"
+	clientAuthVerifyIfGiven = "verify-if-given"
+)
+
+// tlsReloader serves the certificate and client CA bundle of the listener,
+// which are reloaded when their files change.
+type tlsReloader struct {
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+// config returns the TLS configuration of the listener, reading the current
+// certificate and client CA bundle on every handshake.
+func (r *tlsReloader) config() *tls.Config {
+	clientAuth := tls.NoClientCert
+	switch {
+	case tlsClientCAFile == "":
+	case tlsClientAuth == clientAuthVerifyIfGiven:
+		clientAuth = tls.VerifyClientCertIfGiven
+	default:
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		ClientAuth: clientAuth,
+	}
+	base.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return r.certificate, nil
+	}
+	if clientAuth != tls.NoClientCert {
+		base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			cfg := base.Clone()
+			cfg.GetConfigForClient = nil
+			cfg.ClientCAs = r.clientCAs
+			return cfg, nil
+		}
+	}
+	return base
+}
+
+// reload reads again the certificate, key and client CA bundle.
+func (r *tlsReloader) reload() error {
+	certificate, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return fmt.Errorf("couldn't load the tls certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("couldn't parse the tls certificate: %s", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if tlsClientCAFile != "" {
+		if clientCAs, err = loadCertPool(tlsClientCAFile); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	r.mu.Unlock()
+
+	tlsCertificateExpiry.WithLabelValues(tlsCertFile).Set(float64(leaf.NotAfter.Unix()))
+	return nil
+}
+
+// files returns the files holding the tls material.
+func (r *tlsReloader) files() []string {
+	files := []string{tlsCertFile, tlsKeyFile}
+	if tlsClientCAFile != "" {
+		files = append(files, tlsClientCAFile)
+	}
+	return files
+}
+
+// loadCertPool reads a PEM bundle of CA certificates, exposing the expiry of
+// the one expiring first.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	var firstExpiry int64
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse certificate in %s: %s", file, err)
+		}
+		pool.AddCert(cert)
+		if expiry := cert.NotAfter.Unix(); firstExpiry == 0 || expiry < firstExpiry {
+			firstExpiry = expiry
+		}
+	}
+	if firstExpiry == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+
+	tlsCertificateExpiry.WithLabelValues(file).Set(float64(firstExpiry))
+	return pool, nil
+}
+
+// clientCertPrincipal returns the identity of the verified client certificate
+// of a request, either its common name or its first subject alternative name.
+func clientCertPrincipal(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+
+	if tlsClientPrincipal != "san" {
+		return cert.Subject.CommonName
+	}
+	switch {
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// listenAddress returns the address to listen on, honouring the PORT
+// variable the same way gin does.
+func listenAddress() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
+
+// serve runs the http server, over TLS when a certificate is configured.
+func serve(handler http.Handler) error {
+	if tlsCertFile == "" {
+		return http.ListenAndServe(listenAddress(), handler)
+	}
+
+	reloader := &tlsReloader{}
+	if err := reloader.reload(); err != nil {
+		return err
+	}
+	registerReload("tls", reloader.files(), reloader.reload)
+
+	server := &http.Server{
+		Addr:      listenAddress(),
+		Handler:   handler,
+		TLSConfig: reloader.config(),
+	}
+	err := server.ListenAndServeTLS("", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
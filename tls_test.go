@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCert is a certificate generated for the tests, along with its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert generates a certificate from a template, self-signed when
+// there's no parent.
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func newTestCA(t *testing.T, name string) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	certificate, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	assert.Nil(t, err)
+	return certificate
+}
+
+func newServerCert(t *testing.T, ca *testCert, name string) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+}
+
+func newClientCert(t *testing.T, ca *testCert, name string) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{name + ".clients.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	tlsCertFile = filepath.Join(dir, "tls.crt")
+	tlsKeyFile = filepath.Join(dir, "tls.key")
+	tlsClientCAFile = filepath.Join(dir, "client-ca.crt")
+	defer func() { tlsCertFile, tlsKeyFile, tlsClientCAFile, tlsClientPrincipal = "", "", "", "cn" }()
+
+	serverCA, clientCA, untrustedCA := newTestCA(t, "server-ca"), newTestCA(t, "client-ca"), newTestCA(t, "untrusted-ca")
+	writeServerCert := func(name string) {
+		cert := newServerCert(t, serverCA, name)
+		assert.Nil(t, ioutil.WriteFile(tlsCertFile, cert.certPEM(), 0600))
+		assert.Nil(t, ioutil.WriteFile(tlsKeyFile, cert.keyPEM(t), 0600))
+	}
+	writeServerCert("server-a")
+	assert.Nil(t, ioutil.WriteFile(tlsClientCAFile, clientCA.certPEM(), 0600))
+
+	reloader := &tlsReloader{}
+	assert.Nil(t, reloader.reload())
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", reloader.config())
+	assert.Nil(t, err)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, clientCertPrincipal(r))
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	// request returns the common name of the server certificate and the
+	// principal of the client certificate.
+	request := func(client *testCert) (string, string, error) {
+		config := &tls.Config{RootCAs: roots}
+		if client != nil {
+			// The certificate is sent even when the server doesn't trust its
+			// issuer.
+			certificate := client.tlsCertificate(t)
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &certificate, nil
+			}
+		}
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+		resp, err := httpClient.Get("https://" + ln.Addr().String())
+		if err != nil {
+			return "", "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return resp.TLS.PeerCertificates[0].Subject.CommonName, string(body), err
+	}
+
+	serverName, principal, err := request(newClientCert(t, clientCA, "alice"))
+	assert.Nil(t, err)
+	assert.Equal(t, "server-a", serverName)
+	assert.Equal(t, "alice", principal)
+
+	tlsClientPrincipal = "san"
+	_, principal, err = request(newClientCert(t, clientCA, "alice"))
+	assert.Nil(t, err)
+	assert.Equal(t, "alice.clients.example.com", principal)
+
+	_, _, err = request(newClientCert(t, untrustedCA, "mallory"))
+	assert.NotNil(t, err, "clients with an untrusted certificate are rejected")
+	_, _, err = request(nil)
+	assert.NotNil(t, err, "clients without a certificate are rejected")
+
+	// Reloads replace the certificate served to new connections.
+	writeServerCert("server-b")
+	assert.Nil(t, reloader.reload())
+	serverName, _, err = request(newClientCert(t, clientCA, "alice"))
+	assert.Nil(t, err)
+	assert.Equal(t, "server-b", serverName)
+
+	// Failed reloads keep the current certificate.
+	assert.Nil(t, ioutil.WriteFile(tlsKeyFile, []byte("garbage"), 0600))
+	assert.NotNil(t, reloader.reload())
+	serverName, _, err = request(newClientCert(t, clientCA, "alice"))
+	assert.Nil(t, err)
+	assert.Equal(t, "server-b", serverName)
+}
+
+func TestClientCertPrincipal(t *testing.T) {
+	defer func() { tlsClientPrincipal = "cn" }()
+	principal := func(cert *x509.Certificate) string {
+		req, _ := http.NewRequest(http.MethodPost, "/receive", nil)
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		return clientCertPrincipal(req)
+	}
+	spiffe, _ := url.Parse("spiffe://example.com/adapter")
+
+	tlsClientPrincipal = "cn"
+	assert.Equal(t, "alice", principal(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, DNSNames: []string{"alice.example.com"}}))
+	assert.Empty(t, principal(nil), "requests without a verified certificate have no principal")
+
+	tlsClientPrincipal = "san"
+	assert.Equal(t, "alice.example.com", principal(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, DNSNames: []string{"alice.example.com"}, EmailAddresses: []string{"alice@example.com"}}))
+	assert.Equal(t, "alice@example.com", principal(&x509.Certificate{EmailAddresses: []string{"alice@example.com"}, URIs: []*url.URL{spiffe}}))
+	assert.Equal(t, "spiffe://example.com/adapter", principal(&x509.Certificate{URIs: []*url.URL{spiffe}}))
+	assert.Empty(t, principal(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}))
+}